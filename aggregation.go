@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+// statistics summarizes the samples of a series collected between two publish cycles
+type statistics struct {
+	min   float64
+	max   float64
+	sum   float64
+	count float64
+}
+
+// scale returns the statistics of the values multiplied by the factor
+func (st *statistics) scale(factor float64) *statistics {
+	if st == nil {
+		return nil
+	}
+	scaled := &statistics{min: st.min * factor, max: st.max * factor, sum: st.sum * factor, count: st.count}
+	if factor < 0 {
+		scaled.min, scaled.max = scaled.max, scaled.min
+	}
+	return scaled
+}
+
+// sampleAggregator accumulates the samples of each series scraped (or, with statistic sets, received) between
+// two publish cycles, so that they are published as a single StatisticSet datum
+type sampleAggregator struct {
+	mtx     sync.Mutex
+	latest  map[model.Fingerprint]*model.Sample
+	stats   map[model.Fingerprint]*statistics
+	exposed timestampedSeries
+}
+
+func newSampleAggregator() *sampleAggregator {
+	return &sampleAggregator{
+		latest:  make(map[model.Fingerprint]*model.Sample),
+		stats:   make(map[model.Fingerprint]*statistics),
+		exposed: make(timestampedSeries),
+	}
+}
+
+// add accumulates the samples. Values CloudWatch would reject are skipped, and so are samples
+// with the same timestamp as the latest one of the series, as they were already accounted for.
+// `exposed` holds the series of the samples whose timestamp was exposed by their source
+func (a *sampleAggregator) add(vec model.Vector, exposed timestampedSeries) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	for _, s := range vec {
+		value := float64(s.Value)
+		if !validValue(value) {
+			continue
+		}
+
+		fp := s.Metric.Fingerprint()
+		st, ok := a.stats[fp]
+		if !ok {
+			st = &statistics{min: math.Inf(1), max: math.Inf(-1)}
+			a.stats[fp] = st
+		} else if a.latest[fp].Timestamp == s.Timestamp {
+			continue
+		}
+		// Received samples may arrive out of order
+		if latest, ok := a.latest[fp]; !ok || s.Timestamp.After(latest.Timestamp) {
+			a.latest[fp] = s
+			if exposed[fp] {
+				a.exposed[fp] = true
+			} else {
+				delete(a.exposed, fp)
+			}
+		}
+		st.min = math.Min(st.min, value)
+		st.max = math.Max(st.max, value)
+		st.sum += value
+		st.count++
+	}
+}
+
+// drain returns the latest sample and the statistics of each series, and the series whose latest sample has an
+// exposed timestamp, and empties the aggregator
+func (a *sampleAggregator) drain() (model.Vector, map[model.Fingerprint]*statistics, timestampedSeries) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	vec := make(model.Vector, 0, len(a.latest))
+	for _, s := range a.latest {
+		vec = append(vec, s)
+	}
+	stats, exposed := a.stats, a.exposed
+	a.latest = make(map[model.Fingerprint]*model.Sample)
+	a.stats = make(map[model.Fingerprint]*statistics)
+	a.exposed = make(timestampedSeries)
+	return vec, stats, exposed
+}
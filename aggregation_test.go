@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestSampleAggregator(t *testing.T) {
+	up := model.Metric{"__name__": "up"}
+	tests := []struct {
+		name       string
+		scrapes    []model.Vector
+		wantValue  model.SampleValue
+		wantStats  *statistics
+		wantSeries int
+	}{
+		{
+			name: "single scrape",
+			scrapes: []model.Vector{
+				{{Metric: up, Value: 2, Timestamp: 1000}},
+			},
+			wantValue:  2,
+			wantStats:  &statistics{min: 2, max: 2, sum: 2, count: 1},
+			wantSeries: 1,
+		},
+		{
+			name: "several scrapes",
+			scrapes: []model.Vector{
+				{{Metric: up, Value: 3, Timestamp: 1000}},
+				{{Metric: up, Value: 1, Timestamp: 2000}},
+				{{Metric: up, Value: 5, Timestamp: 3000}},
+			},
+			wantValue:  5,
+			wantStats:  &statistics{min: 1, max: 5, sum: 9, count: 3},
+			wantSeries: 1,
+		},
+		{
+			name: "repeated timestamp",
+			scrapes: []model.Vector{
+				{{Metric: up, Value: 3, Timestamp: 1000}},
+				{{Metric: up, Value: 3, Timestamp: 1000}},
+				{{Metric: up, Value: 4, Timestamp: 2000}},
+			},
+			wantValue:  4,
+			wantStats:  &statistics{min: 3, max: 4, sum: 7, count: 2},
+			wantSeries: 1,
+		},
+		{
+			name: "out of order",
+			scrapes: []model.Vector{
+				{{Metric: up, Value: 3, Timestamp: 2000}},
+				{{Metric: up, Value: 1, Timestamp: 1000}},
+			},
+			wantValue:  3,
+			wantStats:  &statistics{min: 1, max: 3, sum: 4, count: 2},
+			wantSeries: 1,
+		},
+		{
+			name: "invalid values",
+			scrapes: []model.Vector{
+				{{Metric: up, Value: model.SampleValue(math.NaN()), Timestamp: 1000}},
+				{{Metric: up, Value: 2, Timestamp: 2000}},
+				{{Metric: up, Value: model.SampleValue(math.Inf(1)), Timestamp: 3000}},
+			},
+			wantValue:  2,
+			wantStats:  &statistics{min: 2, max: 2, sum: 2, count: 1},
+			wantSeries: 1,
+		},
+		{
+			name: "only invalid values",
+			scrapes: []model.Vector{
+				{{Metric: up, Value: model.SampleValue(math.NaN()), Timestamp: 1000}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newSampleAggregator()
+			for _, vec := range tt.scrapes {
+				a.add(vec, nil)
+			}
+			vec, stats, _ := a.drain()
+			if len(vec) != tt.wantSeries || len(stats) != tt.wantSeries {
+				t.Fatalf("drained %d samples and %d statistics, want %d series", len(vec), len(stats), tt.wantSeries)
+			}
+			if tt.wantSeries == 0 {
+				return
+			}
+			if vec[0].Value != tt.wantValue {
+				t.Errorf("latest value = %v, want %v", vec[0].Value, tt.wantValue)
+			}
+			if got := stats[up.Fingerprint()]; !reflect.DeepEqual(got, tt.wantStats) {
+				t.Errorf("statistics = %+v, want %+v", got, tt.wantStats)
+			}
+
+			// The aggregator is empty once drained
+			if vec, stats, _ := a.drain(); len(vec) != 0 || len(stats) != 0 {
+				t.Errorf("drained %v and %v again, want nothing", vec, stats)
+			}
+		})
+	}
+}
+
+func TestPublishAggregatedScrapes(t *testing.T) {
+	var mtx sync.Mutex
+	values := []float64{3, 1, 5, 2}
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		value := values[0]
+		values = values[1:]
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = fmt.Fprintf(w, "queue_depth %v\n", value)
+	}))
+	defer exporter.Close()
+	cw := newFakeCloudWatch(t)
+
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL}, cw)
+	ctx := context.Background()
+	now := model.Now()
+	// The second scrape has the timestamp of the first one, and is skipped
+	for _, at := range []model.Time{now.Add(-30 * time.Second), now.Add(-30 * time.Second), now.Add(-15 * time.Second), now} {
+		if err := b.scrape(ctx, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.publishCollected(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cw.requests) != 1 {
+		t.Fatalf("sent %d requests, want 1", len(cw.requests))
+	}
+	form := cw.requests[0]
+	want := map[string]string{
+		"MetricData.member.1.MetricName":                  "queue_depth",
+		"MetricData.member.1.StatisticValues.SampleCount": "3",
+		"MetricData.member.1.StatisticValues.Sum":         "10",
+		"MetricData.member.1.StatisticValues.Minimum":     "2",
+		"MetricData.member.1.StatisticValues.Maximum":     "5",
+		"MetricData.member.1.Value":                       "",
+	}
+	for k, v := range want {
+		if got := form.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestStatisticsScale(t *testing.T) {
+	st := &statistics{min: -2, max: 4, sum: 6, count: 3}
+	tests := []struct {
+		factor float64
+		want   *statistics
+	}{
+		{1, &statistics{min: -2, max: 4, sum: 6, count: 3}},
+		{1000, &statistics{min: -2000, max: 4000, sum: 6000, count: 3}},
+		{0.5, &statistics{min: -1, max: 2, sum: 3, count: 3}},
+		// The minimum and maximum are swapped by negative factors
+		{-1, &statistics{min: -4, max: 2, sum: -6, count: 3}},
+		{-0.5, &statistics{min: -2, max: 1, sum: -3, count: 3}},
+	}
+	for _, tt := range tests {
+		if got := st.scale(tt.factor); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("scale(%v) = %+v, want %+v", tt.factor, got, tt.want)
+		}
+	}
+	if got := (*statistics)(nil).scale(2); got != nil {
+		t.Errorf("scale of no statistics = %+v, want nil", got)
+	}
+	if st.min != -2 || st.max != 4 {
+		t.Errorf("scale modified the statistics to %+v", st)
+	}
+}
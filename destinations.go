@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/common/model"
+)
+
+// Destination defines an additional region and/or account receiving the same metrics as the primary destination
+type Destination struct {
+	// Required. The AWS Region to publish to
+	Region string
+
+	// ARN of an IAM role to assume to publish, e.g. in another account. Default: the primary credentials
+	RoleArn string
+
+	// External ID to pass when assuming RoleArn
+	ExternalId string
+
+	// The namespace replacing CloudWatchNamespace in this destination. Namespaces from NamespaceLabel and NamespaceRules are kept
+	Namespace string
+}
+
+// destination is a CloudWatch client metrics are published to
+type destination struct {
+	name      string
+	cw        *cloudwatch.CloudWatch
+	namespace string
+	limiter   *rateLimiter
+}
+
+// namespaceBatch is a batch of datums published with a single request.
+// An empty namespace stands for the default namespace of each destination
+type namespaceBatch struct {
+	namespace string
+	data      []*cloudwatch.MetricDatum
+
+	// Values of the publish on change series of the batch, recorded once it is published to every destination
+	changed map[model.Fingerprint]publishedValue
+	// Exposed timestamps of the series of the batch, recorded once it is published to every destination
+	timestamps map[model.Fingerprint]publishedValue
+
+	// Pushed groups with series in the batch, deleted (with PushDeleteAfterPublish) once published to every destination
+	pushGroups map[pushGeneration]bool
+
+	// Whether the batch was published to every destination
+	published bool
+}
+
+func newNamespaceBatch(namespace string) *namespaceBatch {
+	return &namespaceBatch{
+		namespace:  namespace,
+		data:       make([]*cloudwatch.MetricDatum, 0, batchSize),
+		changed:    make(map[model.Fingerprint]publishedValue),
+		timestamps: make(map[model.Fingerprint]publishedValue),
+		pushGroups: make(map[pushGeneration]bool),
+	}
+}
+
+// newDestination creates a client for the destination, assuming its role with the credentials of `sess`
+func newDestination(sess *session.Session, d Destination, defaultNamespace string, rateLimit float64) (*destination, error) {
+	if d.Region == "" {
+		return nil, errors.New("destination region required")
+	}
+
+	config := aws.NewConfig().WithRegion(d.Region)
+	name := d.Region
+	if d.RoleArn != "" {
+		config.Credentials = stscreds.NewCredentials(sess, d.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+			if d.ExternalId != "" {
+				p.ExternalID = aws.String(d.ExternalId)
+			}
+		})
+		name = fmt.Sprintf("%s (%s)", d.Region, d.RoleArn)
+	}
+
+	namespace := defaultNamespace
+	if d.Namespace != "" {
+		namespace = d.Namespace
+	}
+	return &destination{name: name, cw: cloudwatch.New(sess, config), namespace: namespace, limiter: newRateLimiter(rateLimit)}, nil
+}
+
+// publish sends the batches to every destination concurrently, each with a pool of `publishConcurrency` workers.
+// Each destination is retried by its own client and rate limited separately, and a failing destination doesn't
+// prevent publishing to the others. The batches published to every destination are marked as published.
+// The last error of each failing destination is returned
+func (b *Bridge) publish(ctx context.Context, batches []*namespaceBatch) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(b.destinations))
+	// Number of destinations each batch was published to
+	flushed := make([]int, len(batches))
+	var errsMtx sync.Mutex
+
+	for i, d := range b.destinations {
+		jobs := make(chan int)
+		for w := 0; w < b.publishConcurrency; w++ {
+			wg.Add(1)
+			go func(i int, d *destination) {
+				defer wg.Done()
+				for j := range jobs {
+					namespace := batches[j].namespace
+					if namespace == "" {
+						namespace = d.namespace
+					}
+					err := d.flush(ctx, namespace, batches[j].data)
+					errsMtx.Lock()
+					if err != nil {
+						errs[i] = fmt.Errorf("%s: %s", d.name, err)
+					} else {
+						flushed[j]++
+					}
+					errsMtx.Unlock()
+				}
+			}(i, d)
+		}
+		go func() {
+			defer close(jobs)
+			for j := range batches {
+				select {
+				case jobs <- j:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for j, batch := range batches {
+		batch.published = flushed[j] == len(b.destinations)
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("publish cycle interrupted: %s", ctx.Err())
+	}
+
+	var messages []string
+	for _, err := range errs {
+		if err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(messages) > 0 {
+		return errors.New(strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// rateLimiter spaces out requests so that they don't exceed a rate, shared by the workers of a destination
+type rateLimiter struct {
+	mtx      sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter returns a limiter allowing `perSecond` requests per second, or nil (no limit) if it isn't positive
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the next request may be sent, or the context is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mtx.Lock()
+	at := l.next
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mtx.Unlock()
+
+	delay := time.Until(at)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
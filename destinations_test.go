@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublishToDestinations(t *testing.T) {
+	exporter := newBatchingExporter(t, 3)
+	primary := newFakeCloudWatch(t)
+	failing := newFakeCloudWatch(t)
+	failing.setFailing(true)
+	central := newFakeCloudWatch(t)
+
+	b := newTestBridge(t, &Config{
+		PrometheusScrapeUrl: exporter.URL,
+		Destinations: []Destination{
+			{Region: "eu-west-1"},
+			{Region: "us-west-2", Namespace: "Central"},
+		},
+	}, primary)
+	b.destinations[1].cw = newFakeCloudWatchClient(t, "eu-west-1", failing)
+	b.destinations[2].cw = newFakeCloudWatchClient(t, "us-west-2", central)
+
+	_, err := b.PublishOnce(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "eu-west-1") {
+		t.Fatalf("error = %v, want the error of the failing destination", err)
+	}
+	if strings.Contains(err.Error(), "us-east-1") || strings.Contains(err.Error(), "us-west-2") {
+		t.Errorf("error = %v, want only the failing destination", err)
+	}
+
+	for _, tt := range []struct {
+		cw        *fakeCloudWatch
+		namespace string
+	}{
+		{primary, "test"},
+		{central, "Central"},
+	} {
+		if got := len(tt.cw.metricNames()); got != 30 {
+			t.Errorf("published %d metrics into %s, want 30 despite the failing destination", got, tt.namespace)
+		}
+		for _, form := range tt.cw.requests {
+			if ns := form.Get("Namespace"); ns != tt.namespace {
+				t.Errorf("published into namespace %q, want %q", ns, tt.namespace)
+			}
+		}
+	}
+}
+
+// newBatchingExporter serves an exposition with enough series for `batches` PutMetricData requests
+func newBatchingExporter(t *testing.T, batches int) *httptest.Server {
+	var exposition strings.Builder
+	for i := 0; i < batches*batchSize; i++ {
+		fmt.Fprintf(&exposition, "queue_depth{queue=\"q%d\"} 1\n", i)
+	}
+	return newTextExporter(t, exposition.String())
+}
+
+func TestPublishConcurrency(t *testing.T) {
+	exporter := newBatchingExporter(t, 8)
+	cw := newFakeCloudWatch(t)
+	cw.delay = 50 * time.Millisecond
+
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL, PublishConcurrency: 3}, cw)
+	if _, err := b.PublishOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(cw.requests) != 8 {
+		t.Errorf("sent %d requests, want 8", len(cw.requests))
+	}
+	if cw.maxInFlight != 3 {
+		t.Errorf("sent up to %d concurrent requests, want 3", cw.maxInFlight)
+	}
+}
+
+func TestPublishRateLimit(t *testing.T) {
+	exporter := newBatchingExporter(t, 5)
+	cw := newFakeCloudWatch(t)
+
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL, PublishConcurrency: 5, PublishRateLimit: 20}, cw)
+	start := time.Now()
+	if _, err := b.PublishOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(cw.arrivals) != 5 {
+		t.Fatalf("sent %d requests, want 5", len(cw.arrivals))
+	}
+
+	// 20 requests per second are 50ms apart, even with a worker per request, so the last one can't be sent before 200ms.
+	// Only the lower bound is checked, as a loaded machine only delays the requests further
+	var last time.Time
+	for _, at := range cw.arrivals {
+		if at.After(last) {
+			last = at
+		}
+	}
+	if elapsed := last.Sub(start); elapsed < 200*time.Millisecond {
+		t.Errorf("sent 5 requests within %s, want at least 200ms at 20 requests per second", elapsed)
+	}
+}
+
+func TestRateLimiterCancelled(t *testing.T) {
+	l := newRateLimiter(0.1)
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatalf("first wait error = %v, want no delay", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx); err == nil {
+		t.Error("wait succeeded, want the context error instead of waiting 10s")
+	}
+
+	if newRateLimiter(0) != nil {
+		t.Error("newRateLimiter(0) returned a limiter, want no limit")
+	}
+}
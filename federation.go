@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// federationStrippedLabels are the target labels removed from federated series when requested,
+// so that series are aggregated across the targets of the federated server
+var federationStrippedLabels = []model.LabelName{model.InstanceLabel, model.JobLabel}
+
+// federateUrl returns the URL of the /federate endpoint of the Prometheus server at `base`,
+// with a match[] parameter for each series selector.
+// /federate is appended to the path of `base` unless it already ends with it, so that servers with a route prefix
+// (e.g. http://prometheus:9090/prometheus) are supported. Query parameters already present in `base` are preserved
+func federateUrl(base string, selectors []string) (string, error) {
+	if len(selectors) == 0 {
+		return "", errors.New("at least one series selector is required for federation")
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(u.Path, "/federate") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/federate"
+	}
+
+	params := u.Query()
+	for _, selector := range selectors {
+		params.Add("match[]", selector)
+	}
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
+
+// stripFederationLabels removes the instance and job labels from the samples
+func stripFederationLabels(vec model.Vector) {
+	for _, s := range vec {
+		for _, name := range federationStrippedLabels {
+			delete(s.Metric, name)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestFederateUrl(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      string
+		selectors []string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "no path",
+			base:      "http://prometheus:9090",
+			selectors: []string{"up"},
+			want:      "http://prometheus:9090/federate?match%5B%5D=up",
+		},
+		{
+			name:      "root path",
+			base:      "http://prometheus:9090/",
+			selectors: []string{"up"},
+			want:      "http://prometheus:9090/federate?match%5B%5D=up",
+		},
+		{
+			name:      "route prefix",
+			base:      "http://prometheus:9090/prometheus",
+			selectors: []string{"up"},
+			want:      "http://prometheus:9090/prometheus/federate?match%5B%5D=up",
+		},
+		{
+			name:      "route prefix with trailing slash",
+			base:      "http://prometheus:9090/prometheus/",
+			selectors: []string{"up"},
+			want:      "http://prometheus:9090/prometheus/federate?match%5B%5D=up",
+		},
+		{
+			name:      "federate path",
+			base:      "http://prometheus:9090/prometheus/federate",
+			selectors: []string{"up"},
+			want:      "http://prometheus:9090/prometheus/federate?match%5B%5D=up",
+		},
+		{
+			name:      "several selectors and existing parameters",
+			base:      "http://prometheus:9090/federate?partial_response=true",
+			selectors: []string{`{job="node"}`, "up"},
+			want:      "http://prometheus:9090/federate?match%5B%5D=%7Bjob%3D%22node%22%7D&match%5B%5D=up&partial_response=true",
+		},
+		{
+			name:    "no selectors",
+			base:    "http://prometheus:9090",
+			wantErr: true,
+		},
+		{
+			name:      "invalid URL",
+			base:      "http://prometheus:port",
+			selectors: []string{"up"},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := federateUrl(tt.base, tt.selectors)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("federateUrl() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("federateUrl() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripFederationLabels(t *testing.T) {
+	vec := model.Vector{
+		{Metric: model.Metric{"__name__": "up", "instance": "node-1:9100", "job": "node", "zone": "a"}, Value: 1},
+		{Metric: model.Metric{"__name__": "build_info", "version": "1.0"}, Value: 1},
+	}
+	stripFederationLabels(vec)
+
+	want := []model.Metric{
+		{"__name__": "up", "zone": "a"},
+		{"__name__": "build_info", "version": "1.0"},
+	}
+	for i, s := range vec {
+		if !reflect.DeepEqual(s.Metric, want[i]) {
+			t.Errorf("labels = %v, want %v", s.Metric, want[i])
+		}
+	}
+}
@@ -3,7 +3,13 @@ module github.com/cloudposse/prometheus-to-cloudwatch
 go 1.14
 
 require (
-	github.com/aws/aws-sdk-go v1.35.21 // indirect
-	github.com/gobwas/glob v0.2.3 // indirect
-	github.com/prometheus/common v0.14.0 // indirect
+	github.com/aws/aws-lambda-go v1.20.0
+	github.com/aws/aws-sdk-go v1.35.21
+	github.com/gobwas/glob v0.2.3
+	github.com/golang/protobuf v1.4.2
+	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
+	github.com/matttproud/golang_protobuf_extensions v1.0.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.14.0
+	google.golang.org/protobuf v1.23.0
 )
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// runningInLambda reports whether the bridge is running as an AWS Lambda function
+func runningInLambda() bool {
+	return os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != ""
+}
+
+// runLambda starts the AWS Lambda handler. Each invocation (e.g. from an EventBridge schedule) performs a single
+// scrape-transform-publish cycle with Bridge.PublishOnce. The event payload is ignored.
+// Push receivers are not available in Lambda, as nothing runs between invocations
+func runLambda(bridge *Bridge) {
+	lambda.Start(func(ctx context.Context) (string, error) {
+		return handleLambda(ctx, bridge)
+	})
+}
+
+// handleLambda publishes once and returns the result of the invocation. A failed scrape only fails the invocation
+// when nothing else was published, as the retry of a failed asynchronous invocation would publish the other sources again
+func handleLambda(ctx context.Context, bridge *Bridge) (string, error) {
+	count, err := bridge.PublishOnce(ctx)
+	var scrapeErr *ScrapeError
+	if errors.As(err, &scrapeErr) && count > 0 {
+		log.Printf("prometheus-to-cloudwatch: published the other sources, but %s", scrapeErr)
+		err = nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error publishing to CloudWatch: %s", err)
+	}
+	msg := fmt.Sprintf("published %d metrics to CloudWatch", count)
+	log.Println("prometheus-to-cloudwatch:", msg)
+	return msg, nil
+}
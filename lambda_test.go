@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandleLambdaScrapeError(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer exporter.Close()
+	cw := newFakeCloudWatch(t)
+
+	// Nothing else was published, the invocation fails to be retried
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL}, cw)
+	if _, err := handleLambda(context.Background(), b); err == nil {
+		t.Error("handleLambda succeeded, want the scrape error")
+	}
+
+	// The textfiles were published, a retry would publish them again
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "backup.prom"), []byte("backup_success 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b = newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL, TextfileDirectory: dir}, cw)
+	if _, err := handleLambda(context.Background(), b); err != nil {
+		t.Errorf("handleLambda error = %v, want the partial failure logged", err)
+	}
+	if got := cw.metricNames(); len(got) != 1 || got[0] != "backup_success" {
+		t.Errorf("published %v, want backup_success", got)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
@@ -13,28 +14,87 @@ import (
 	"time"
 
 	"github.com/gobwas/glob"
+	"github.com/prometheus/common/model"
 )
 
 var defaultForceHighRes, _ = strconv.ParseBool(os.Getenv("FORCE_HIGH_RES"))
+var defaultInferUnits, _ = strconv.ParseBool(os.Getenv("INFER_UNITS"))
+var defaultPascalCaseNames, _ = strconv.ParseBool(os.Getenv("PASCAL_CASE_NAMES"))
+var defaultStatisticSets, _ = strconv.ParseBool(os.Getenv("STATISTIC_SETS"))
+var defaultHonorTimestamps, _ = strconv.ParseBool(os.Getenv("HONOR_TIMESTAMPS"))
+var defaultFederationStripLabels, _ = strconv.ParseBool(os.Getenv("FEDERATION_STRIP_LABELS"))
+var defaultRemoteWriteReceiver, _ = strconv.ParseBool(os.Getenv("REMOTE_WRITE_RECEIVER"))
+var defaultPushReceiver, _ = strconv.ParseBool(os.Getenv("PUSH_RECEIVER"))
+var defaultPushDeleteAfterPublish, _ = strconv.ParseBool(os.Getenv("PUSH_DELETE_AFTER_PUBLISH"))
+var defaultOTLPReceiver, _ = strconv.ParseBool(os.Getenv("OTLP_RECEIVER"))
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
 
 var (
 	awsAccessKeyId              = flag.String("aws_access_key_id", os.Getenv("AWS_ACCESS_KEY_ID"), "AWS access key Id with permissions to publish CloudWatch metrics")
 	awsSecretAccessKey          = flag.String("aws_secret_access_key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "AWS secret access key with permissions to publish CloudWatch metrics")
 	awsSessionToken             = flag.String("aws_session_token", os.Getenv("AWS_SESSION_TOKEN"), "AWS session token with permissions to publish CloudWatch metrics")
 	cloudWatchNamespace         = flag.String("cloudwatch_namespace", os.Getenv("CLOUDWATCH_NAMESPACE"), "CloudWatch Namespace")
+	namespaceLabel              = flag.String("namespace_label", os.Getenv("NAMESPACE_LABEL"), "Publish each sample into the CloudWatch namespace given by this label (e.g. 'cw_namespace'). The label is not published as a dimension")
+	namespaceRules              = flag.String("namespace_rules", os.Getenv("NAMESPACE_RULES"), "Publish metrics into the namespace of the first matching rule (semi-colon-separated list of GLOB=NAMESPACE, e.g. 'kafka_*=Kafka/Brokers;jvm_*=JVM')")
 	cloudWatchRegion            = flag.String("cloudwatch_region", os.Getenv("CLOUDWATCH_REGION"), "CloudWatch Region")
+	destinations                = flag.String("destinations", os.Getenv("DESTINATIONS"), "Additional regions and accounts to publish the same metrics to (semi-colon-separated list of comma-separated KEY=VALUE with keys region, role_arn, external_id and namespace, e.g. 'region=eu-west-1;region=us-east-1,role_arn=arn:aws:iam::123456789012:role/cloudwatch,namespace=Central')")
 	cloudWatchPublishTimeout    = flag.String("cloudwatch_publish_timeout", os.Getenv("CLOUDWATCH_PUBLISH_TIMEOUT"), "CloudWatch publish timeout in seconds")
+	publishConcurrency          = flag.String("publish_concurrency", os.Getenv("PUBLISH_CONCURRENCY"), "Number of concurrent PutMetricData requests per destination (default 4)")
+	publishRateLimit            = flag.String("publish_rate_limit", os.Getenv("PUBLISH_RATE_LIMIT"), "Maximum PutMetricData requests per second per destination, to stay within the CloudWatch TPS quota (default no limit)")
+	publishCycleTimeout         = flag.String("publish_cycle_timeout", os.Getenv("PUBLISH_CYCLE_TIMEOUT"), "Deadline in seconds of a scrape and publish cycle, after which remaining batches are dropped (default the publish interval)")
+	cloudWatchPublishInterval   = flag.String("cloudwatch_publish_interval", os.Getenv("CLOUDWATCH_PUBLISH_INTERVAL"), "CloudWatch publish interval in seconds. Scrapes between two publishes are aggregated into statistic sets (default the scrape interval)")
 	prometheusScrapeInterval    = flag.String("prometheus_scrape_interval", os.Getenv("PROMETHEUS_SCRAPE_INTERVAL"), "Prometheus scrape interval in seconds")
 	prometheusScrapeUrl         = flag.String("prometheus_scrape_url", os.Getenv("PROMETHEUS_SCRAPE_URL"), "Prometheus scrape URL")
+	federationMatch             = flag.String("federation_match", os.Getenv("FEDERATION_MATCH"), "Federate the specified series from the Prometheus server at `prometheus_scrape_url` (semi-colon-separated list of series selectors, e.g. '{job=\"node\"};up')")
+	federationStripLabels       = flag.Bool("federation_strip_labels", defaultFederationStripLabels, "Remove the instance and job labels from federated series")
+	listenAddress               = flag.String("listen_address", os.Getenv("LISTEN_ADDRESS"), "Address of the HTTP server of the push receivers (default ':9099')")
+	remoteWriteReceiver         = flag.Bool("remote_write_receiver", defaultRemoteWriteReceiver, "Accept Prometheus remote-write requests on /api/v1/write and publish the received samples")
+	pushReceiver                = flag.Bool("push_receiver", defaultPushReceiver, "Accept Pushgateway-compatible pushes on /metrics/job/<JOB>{/<LABEL>/<VALUE>} and publish the pushed metrics on every cycle until deleted")
+	pushDeleteAfterPublish      = flag.Bool("push_delete_after_publish", defaultPushDeleteAfterPublish, "Delete pushed metrics once they have been published")
+	otlpReceiver                = flag.Bool("otlp_receiver", defaultOTLPReceiver, "Accept OTLP/HTTP metric exports (protobuf or JSON) on /v1/metrics and publish the received data points")
+	otlpResourceAttributes      = flag.String("otlp_resource_attributes", os.Getenv("OTLP_RESOURCE_ATTRIBUTES"), "OTLP resource attributes added as dimensions (comma-separated list, e.g. 'service.name,host.name'), or '*' for all of them. Default: 'service.name,service.namespace,deployment.environment'")
+	statsdListenAddress         = flag.String("statsd_listen_address", os.Getenv("STATSD_LISTEN_ADDRESS"), "UDP address to receive StatsD and DogStatsD metrics on (e.g. ':8125'). Metrics are aggregated per publish interval")
+	textfileDirectory           = flag.String("textfile_directory", os.Getenv("TEXTFILE_DIRECTORY"), "Directory to read *.prom files from on every cycle, like the node_exporter textfile collector")
+	prometheusQueryUrl          = flag.String("prometheus_query_url", os.Getenv("PROMETHEUS_QUERY_URL"), "Base URL of a Prometheus or Thanos server to run `prometheus_queries` against (e.g. 'http://prometheus:9090')")
+	prometheusQueries           = flag.String("prometheus_queries", os.Getenv("PROMETHEUS_QUERIES"), "PromQL queries whose results are published under the query name (semi-colon-separated list of NAME=EXPR, e.g. 'http_error_rate=sum by (job) (rate(http_errors_total[5m]))')")
 	certPath                    = flag.String("cert_path", os.Getenv("CERT_PATH"), "Path to SSL Certificate file (when using SSL for `prometheus_scrape_url`)")
 	keyPath                     = flag.String("key_path", os.Getenv("KEY_PATH"), "Path to Key file (when using SSL for `prometheus_scrape_url`)")
-	skipServerCertCheck         = flag.String("accept_invalid_cert", os.Getenv("ACCEPT_INVALID_CERT"), "Accept any certificate during TLS handshake. Insecure, use only for testing")
+	skipServerCertCheck         = flag.String("accept_invalid_cert", os.Getenv("ACCEPT_INVALID_CERT"), "Accept any certificate during TLS handshake. Insecure, use only for testing. Default: true for compatibility with previous versions, so the certificate is not verified unless this is set to false or `ca_path`, `tls_server_name` or `tls_min_version` is provided (then the default is false)")
+	caPath                      = flag.String("ca_path", os.Getenv("CA_PATH"), "Path to a CA bundle used to verify the server certificate (when using SSL for `prometheus_scrape_url`)")
+	tlsServerName               = flag.String("tls_server_name", os.Getenv("TLS_SERVER_NAME"), "Server name used to verify the server certificate (when using SSL for `prometheus_scrape_url`)")
+	tlsMinVersion               = flag.String("tls_min_version", os.Getenv("TLS_MIN_VERSION"), "Minimum TLS version accepted when scraping `prometheus_scrape_url` (1.0, 1.1, 1.2 or 1.3)")
+	bearerToken                 = flag.String("bearer_token", os.Getenv("BEARER_TOKEN"), "Bearer token sent in the Authorization header when scraping `prometheus_scrape_url`")
+	bearerTokenFile             = flag.String("bearer_token_file", os.Getenv("BEARER_TOKEN_FILE"), "Path to a file containing the bearer token sent when scraping `prometheus_scrape_url`. Re-read on every scrape")
+	basicAuthUsername           = flag.String("basic_auth_username", os.Getenv("BASIC_AUTH_USERNAME"), "Username for basic authentication when scraping `prometheus_scrape_url`")
+	basicAuthPassword           = flag.String("basic_auth_password", os.Getenv("BASIC_AUTH_PASSWORD"), "Password for basic authentication when scraping `prometheus_scrape_url`")
+	scrapeHeaders               = flag.String("prometheus_scrape_headers", os.Getenv("PROMETHEUS_SCRAPE_HEADERS"), "Additional headers sent when scraping `prometheus_scrape_url` specified by NAME=VALUE,...")
 	additionalDimension         = flag.String("additional_dimension", os.Getenv("ADDITIONAL_DIMENSION"), "Additional dimension specified by NAME=VALUE")
+	additionalDimensions        = flag.String("additional_dimensions", os.Getenv("ADDITIONAL_DIMENSIONS"), "Additional dimensions (semi-colon-separated list of NAME=VALUE, where values are templates over sample labels, hostname and env vars, e.g. 'Service={{ .Labels.job }}-{{ env \"STAGE\" }};Host={{ .Hostname }}')")
 	replaceDimensions           = flag.String("replace_dimensions", os.Getenv("REPLACE_DIMENSIONS"), "replace dimensions specified by NAME=VALUE,...")
 	includeMetrics              = flag.String("include_metrics", os.Getenv("INCLUDE_METRICS"), "Only publish the specified metrics (comma-separated list of glob patterns, e.g. 'up,http_*')")
 	excludeMetrics              = flag.String("exclude_metrics", os.Getenv("EXCLUDE_METRICS"), "Never publish the specified metrics (comma-separated list of glob patterns, e.g. 'tomcat_*')")
 	includeDimensionsForMetrics = flag.String("include_dimensions_for_metrics", os.Getenv("INCLUDE_DIMENSIONS_FOR_METRICS"), "Only publish the specified dimensions for metrics (semi-colon-separated key values of comma-separated dimensions of METRIC=dim1,dim2;, e.g. 'flink_jobmanager=job_id')")
 	excludeDimensionsForMetrics = flag.String("exclude_dimensions_for_metrics", os.Getenv("EXCLUDE_DIMENSIONS_FOR_METRICS"), "Never publish the specified dimensions for metrics (semi-colon-separated key values of comma-separated dimensions of METRIC=dim1,dim2;, e.g. 'flink_jobmanager=job,host;zk_up=host,pod;')")
+	publishOnChange             = flag.String("publish_on_change", os.Getenv("PUBLISH_ON_CHANGE"), "Only publish the specified metrics when their value changes or the heartbeat expired (comma-separated list of glob patterns, e.g. 'up,*_info')")
+	publishOnChangeHeartbeat    = flag.String("publish_on_change_heartbeat", os.Getenv("PUBLISH_ON_CHANGE_HEARTBEAT"), "Interval in seconds after which unchanged values of `publish_on_change` metrics are published again (default 300)")
+	maxDimensions               = flag.String("max_dimensions", os.Getenv("MAX_DIMENSIONS"), "Maximum number of dimensions of a published metric, including additional dimensions (default and maximum 30)")
+	dimensionPriorities         = flag.String("dimension_priorities", os.Getenv("DIMENSION_PRIORITIES"), "Labels kept first, in order, when a metric has more labels than `max_dimensions` (semi-colon-separated key values of comma-separated dimensions of METRIC=dim1,dim2;, e.g. 'kafka_*=topic,partition;*=service')")
+	honorTimestamps             = flag.Bool("honor_timestamps", defaultHonorTimestamps, "Publish samples with the timestamps exposed by the scrape target instead of the scrape time, dropping samples outside the CloudWatch window and unchanged samples already published")
+	maxSampleAge                = flag.String("max_sample_age", os.Getenv("MAX_SAMPLE_AGE"), "Drop samples whose exposed timestamp is older than this many seconds (only with `honor_timestamps`)")
+	renameMetrics               = flag.String("rename_metrics", os.Getenv("RENAME_METRICS"), "Rename the matching metrics (semi-colon-separated list of REGEX=REPLACEMENT, where the replacement may reference capture groups and is a template over sample labels, e.g. 'rabbitmq_queue_(.*)={{ .Labels.queue }}_$1')")
+	stripPrefixes               = flag.String("strip_prefixes", os.Getenv("STRIP_PREFIXES"), "Remove the first matching prefix from the names of metrics not renamed by `rename_metrics` (comma-separated list, e.g. 'node_,app_')")
+	stripSuffixes               = flag.String("strip_suffixes", os.Getenv("STRIP_SUFFIXES"), "Remove the first matching suffix from the names of metrics not renamed by `rename_metrics` (comma-separated list, e.g. '_total')")
+	pascalCaseNames             = flag.Bool("pascal_case_names", defaultPascalCaseNames, "Convert the published metric names from snake_case to PascalCase (e.g. 'http_requests_total' to 'HttpRequestsTotal')")
+	inferUnits                  = flag.Bool("infer_units", defaultInferUnits, "Set the unit of metrics without the label "+cwUnitLabel+" from their name (e.g. '_seconds' is Seconds, '_bytes' is Bytes, '_total' is Count and '_ratio' is Percent scaled by 100)")
+	unitOverrides               = flag.String("unit_overrides", os.Getenv("UNIT_OVERRIDES"), "Set the unit of the matching metrics (semi-colon-separated list of GLOB=UNIT with CloudWatch units, e.g. 'jvm_memory_*=Bytes;*_latency=Milliseconds')")
+	unitConversions             = flag.String("unit_conversions", os.Getenv("UNIT_CONVERSIONS"), "Multiply or divide the values of the matching metrics and set their unit (semi-colon-separated list of GLOB=UNIT*FACTOR or GLOB=UNIT/DIVISOR, e.g. '*_seconds=Milliseconds*1000;*_ratio=Percent*100;*_bytes=Megabytes/1048576')")
+	statisticSets               = flag.Bool("statistic_sets", defaultStatisticSets, "Publish every series as a statistic set (minimum, maximum, sum and sample count) of its samples during the publish interval, including all samples received by the remote-write and OTLP receivers, instead of the latest value")
 	forceHighRes                = flag.Bool("force_high_res", defaultForceHighRes, "Publish all metrics with high resolution, even when original metrics don't have the label "+cwHighResLabel)
 )
 
@@ -78,6 +138,156 @@ func dimensionMatcherListMustParse(str, flag string) []MatcherWithStringSet {
 	return matcherList
 }
 
+// namespaceRuleListMustParse takes a string and a flag name and exits with a message
+// if it cannot parse as GLOB=NAMESPACE;GLOB2=NAMESPACE2
+func namespaceRuleListMustParse(str, flag string) []NamespaceRule {
+	var rules []NamespaceRule
+	for _, rule := range strings.Split(str, ";") {
+		key, val := keyValMustParse(rule, fmt.Sprintf("%s must be formatted as METRIC_NAME=NAMESPACE;...", flag))
+
+		metricPattern, err := glob.Compile(key)
+		if err != nil {
+			log.Fatal(fmt.Errorf("prometheus-to-cloudwatch: Error: %s contains invalid glob pattern in '%s': %s", flag, key, err))
+		}
+		if val == "" {
+			log.Fatalf("prometheus-to-cloudwatch: Error: %s was not given a namespace for metric '%s'", flag, key)
+		}
+		rules = append(rules, NamespaceRule{Matcher: metricPattern, Namespace: val})
+	}
+	return rules
+}
+
+// destinationListMustParse takes a string and a flag name and exits with a message
+// if it cannot parse as KEY=VALUE,KEY2=VALUE2;KEY=VALUE
+func destinationListMustParse(str, flag string) []Destination {
+	var destinations []Destination
+	for _, sublist := range strings.Split(str, ";") {
+		var d Destination
+		for _, kv := range strings.Split(sublist, ",") {
+			key, val := keyValMustParse(kv, fmt.Sprintf("%s must be formatted as KEY=VALUE,...;...", flag))
+			switch key {
+			case "region":
+				d.Region = val
+			case "role_arn":
+				d.RoleArn = val
+			case "external_id":
+				d.ExternalId = val
+			case "namespace":
+				d.Namespace = val
+			default:
+				log.Fatalf("prometheus-to-cloudwatch: Error: %s contains unknown key '%s'", flag, key)
+			}
+		}
+		if d.Region == "" {
+			log.Fatalf("prometheus-to-cloudwatch: Error: %s was not given a region in '%s'", flag, sublist)
+		}
+		destinations = append(destinations, d)
+	}
+	return destinations
+}
+
+// unitOverrideListMustParse takes a string and a flag name and exits with a message
+// if it cannot parse as GLOB=UNIT;GLOB2=UNIT2
+func unitOverrideListMustParse(str, flag string) []UnitOverride {
+	var overrides []UnitOverride
+	for _, kv := range strings.Split(str, ";") {
+		key, val := keyValMustParse(kv, fmt.Sprintf("%s must be formatted as METRIC_NAME=UNIT;...", flag))
+
+		o, err := NewUnitOverride(key, val)
+		if err != nil {
+			log.Fatal(fmt.Errorf("prometheus-to-cloudwatch: Error: %s contains invalid override for '%s': %s", flag, key, err))
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides
+}
+
+// unitConversionListMustParse takes a string and a flag name and exits with a message
+// if it cannot parse as GLOB=UNIT*FACTOR;GLOB2=UNIT/DIVISOR
+func unitConversionListMustParse(str, flag string) []UnitConversion {
+	var conversions []UnitConversion
+	for _, kv := range strings.Split(str, ";") {
+		key, val := keyValMustParse(kv, fmt.Sprintf("%s must be formatted as METRIC_NAME=UNIT*FACTOR;...", flag))
+
+		c, err := ParseUnitConversion(key, val)
+		if err != nil {
+			log.Fatal(fmt.Errorf("prometheus-to-cloudwatch: Error: %s contains invalid conversion for '%s': %s", flag, key, err))
+		}
+		conversions = append(conversions, c)
+	}
+	return conversions
+}
+
+// renameRuleListMustParse takes a string and a flag name and exits with a message
+// if it cannot parse as REGEX=REPLACEMENT;REGEX2=REPLACEMENT2
+func renameRuleListMustParse(str, flag string) []RenameRule {
+	var rules []RenameRule
+	for _, kv := range strings.Split(str, ";") {
+		key, val := keyValMustParse(kv, fmt.Sprintf("%s must be formatted as REGEX=REPLACEMENT;...", flag))
+
+		rule, err := NewRenameRule(key, val)
+		if err != nil {
+			log.Fatal(fmt.Errorf("prometheus-to-cloudwatch: Error: %s contains invalid rule for '%s': %s", flag, key, err))
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// dimensionPriorityListMustParse takes a string and a flag name and exits with a message
+// if it cannot parse as GLOB=dim1,dim2;GLOB2=dim3
+func dimensionPriorityListMustParse(str, flag string) []MatcherWithStringList {
+	var matcherList []MatcherWithStringList
+	for _, sublist := range strings.Split(str, ";") {
+		key, val := keyValMustParse(sublist, fmt.Sprintf("%s must be formatted as METRIC_NAME=DIM_LIST;...", flag))
+
+		metricPattern, err := glob.Compile(key)
+		if err != nil {
+			log.Fatal(fmt.Errorf("prometheus-to-cloudwatch: Error: %s contains invalid glob pattern in '%s': %s", flag, key, err))
+		}
+		matcherList = append(matcherList, MatcherWithStringList{Matcher: metricPattern, List: strings.Split(val, ",")})
+	}
+	return matcherList
+}
+
+// additionalDimensionListMustParse takes a string and a flag name and exits with a message
+// if it cannot parse as NAME=TEMPLATE;NAME2=TEMPLATE2
+func additionalDimensionListMustParse(str, flag string) []AdditionalDimension {
+	var dims []AdditionalDimension
+	for _, kv := range strings.Split(str, ";") {
+		key, val := keyValMustParse(kv, fmt.Sprintf("%s must be formatted as NAME=VALUE;...", flag))
+
+		dim, err := NewAdditionalDimension(key, val)
+		if err != nil {
+			log.Fatal(fmt.Errorf("prometheus-to-cloudwatch: Error: %s contains invalid template for dimension '%s': %s", flag, key, err))
+		}
+		dims = append(dims, dim)
+	}
+	return dims
+}
+
+// promQLQueryListMustParse takes a string and a flag name and exits with a message
+// if it cannot parse as NAME=EXPR;NAME2=EXPR2
+func promQLQueryListMustParse(str, flag string) []PromQLQuery {
+	var queries []PromQLQuery
+	for _, item := range strings.Split(str, ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		name, expr := keyValMustParse(item, fmt.Sprintf("%s must be formatted as NAME=EXPR;...", flag))
+		name, expr = strings.TrimSpace(name), strings.TrimSpace(expr)
+
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			log.Fatalf("prometheus-to-cloudwatch: Error: %s query name '%s' is not a valid metric name", flag, name)
+		}
+		if expr == "" {
+			log.Fatalf("prometheus-to-cloudwatch: Error: %s was not given an expression for query '%s'", flag, name)
+		}
+		queries = append(queries, PromQLQuery{Name: name, Expr: expr})
+	}
+	return queries
+}
+
 // stringSliceToSet creates a "set" (a boolean map) from a slice of strings
 func stringSliceToSet(slice []string) StringSet {
 	boolMap := make(StringSet, len(slice))
@@ -100,28 +310,89 @@ func main() {
 		flag.PrintDefaults()
 		log.Fatal("prometheus-to-cloudwatch: Error: -cloudwatch_region or CLOUDWATCH_REGION required")
 	}
-	if *prometheusScrapeUrl == "" {
+	if *prometheusScrapeUrl == "" && *prometheusQueries == "" && !*remoteWriteReceiver && !*pushReceiver && !*otlpReceiver && *statsdListenAddress == "" && *textfileDirectory == "" {
 		flag.PrintDefaults()
-		log.Fatal("prometheus-to-cloudwatch: Error: -prometheus_scrape_url or PROMETHEUS_SCRAPE_URL required")
+		log.Fatal("prometheus-to-cloudwatch: Error: -prometheus_scrape_url or PROMETHEUS_SCRAPE_URL required, unless metrics are queried or received")
+	}
+	if *prometheusQueries != "" && *prometheusQueryUrl == "" {
+		flag.PrintDefaults()
+		log.Fatal("prometheus-to-cloudwatch: Error: -prometheus_query_url or PROMETHEUS_QUERY_URL required when using -prometheus_queries")
 	}
 	if (*certPath != "" && *keyPath == "") || (*certPath == "" && *keyPath != "") {
 		flag.PrintDefaults()
 		log.Fatal("prometheus-to-cloudwatch: Error: when using SSL, both -prometheus_cert_path and -prometheus_key_path are required. If not using SSL, do not provide any of them")
 	}
 
-	var skipCertCheck = true
+	// Server certificates aren't verified by default, to preserve the previous behavior,
+	// unless any TLS verification option is provided
+	var skipCertCheck = *caPath == "" && *tlsServerName == "" && *tlsMinVersion == ""
 	var err error
 
 	if *skipServerCertCheck != "" {
 		if skipCertCheck, err = strconv.ParseBool(*skipServerCertCheck); err != nil {
 			log.Fatal("prometheus-to-cloudwatch: Error: ", err)
 		}
+		if skipCertCheck && (*caPath != "" || *tlsServerName != "" || *tlsMinVersion != "") {
+			log.Fatal("prometheus-to-cloudwatch: Error: -accept_invalid_cert can't be combined with -ca_path, -tls_server_name or -tls_min_version, as the certificate wouldn't be verified")
+		}
 	}
 
-	var additionalDimensions = map[string]string{}
+	var dimensions []AdditionalDimension
 	if *additionalDimension != "" {
-		key, val := keyValMustParse(*additionalDimension, "-additionalDimension must be formatted as NAME=VALUE")
-		additionalDimensions[key] = val
+		key, val := keyValMustParse(*additionalDimension, "-additional_dimension must be formatted as NAME=VALUE")
+		dim, err := NewStaticDimension(key, val)
+		if err != nil {
+			log.Fatal("prometheus-to-cloudwatch: Error: -additional_dimension: ", err)
+		}
+		dimensions = append(dimensions, dim)
+	}
+	if *additionalDimensions != "" {
+		dimensions = append(dimensions, additionalDimensionListMustParse(*additionalDimensions, "-additional_dimensions")...)
+	}
+
+	var minTLSVersion uint16
+	if *tlsMinVersion != "" {
+		var ok bool
+		if minTLSVersion, ok = tlsVersions[*tlsMinVersion]; !ok {
+			flag.PrintDefaults()
+			log.Fatalf("prometheus-to-cloudwatch: Error: -tls_min_version must be one of 1.0, 1.1, 1.2 or 1.3, got '%s'", *tlsMinVersion)
+		}
+	}
+
+	if *bearerToken != "" && *bearerTokenFile != "" {
+		flag.PrintDefaults()
+		log.Fatal("prometheus-to-cloudwatch: Error: only one of -bearer_token and -bearer_token_file may be provided")
+	}
+	if (*bearerToken != "" || *bearerTokenFile != "") && *basicAuthUsername != "" {
+		flag.PrintDefaults()
+		log.Fatal("prometheus-to-cloudwatch: Error: only one of bearer token and basic authentication may be provided")
+	}
+
+	var headers = map[string]string{}
+	if *scrapeHeaders != "" {
+		for _, h := range strings.Split(*scrapeHeaders, ",") {
+			key, val := keyValMustParse(h, "-prometheus_scrape_headers must be formatted as NAME=VALUE,...")
+			headers[key] = val
+		}
+	}
+
+	var federationMatchers []string
+	if *federationMatch != "" {
+		for _, selector := range strings.Split(*federationMatch, ";") {
+			if selector = strings.TrimSpace(selector); selector != "" {
+				federationMatchers = append(federationMatchers, selector)
+			}
+		}
+	}
+
+	var resourceAttributes []string
+	if *otlpResourceAttributes != "" {
+		resourceAttributes = strings.Split(*otlpResourceAttributes, ",")
+	}
+
+	var queries []PromQLQuery
+	if *prometheusQueries != "" {
+		queries = promQLQueryListMustParse(*prometheusQueries, "-prometheus_queries")
 	}
 
 	var replaceDims = map[string]string{}
@@ -157,6 +428,17 @@ func main() {
 		}
 	}
 
+	var publishOnChangeList []glob.Glob
+	if *publishOnChange != "" {
+		for _, pattern := range strings.Split(*publishOnChange, ",") {
+			g, err := glob.Compile(pattern)
+			if err != nil {
+				log.Fatal(fmt.Errorf("prometheus-to-cloudwatch: Error: -publish_on_change contains invalid glob pattern in '%s': %s", pattern, err))
+			}
+			publishOnChangeList = append(publishOnChangeList, g)
+		}
+	}
+
 	var excludeDimensionsForMetricsList []MatcherWithStringSet
 	if *excludeDimensionsForMetrics != "" {
 		excludeDimensionsForMetricsList = dimensionMatcherListMustParse(*excludeDimensionsForMetrics, "-exclude_dimensions_for_metrics")
@@ -167,23 +449,97 @@ func main() {
 		includeDimensionsForMetricsList = dimensionMatcherListMustParse(*includeDimensionsForMetrics, "-include_dimensions_for_metrics")
 	}
 
+	var namespaceRuleList []NamespaceRule
+	if *namespaceRules != "" {
+		namespaceRuleList = namespaceRuleListMustParse(*namespaceRules, "-namespace_rules")
+	}
+
+	var renameRuleList []RenameRule
+	if *renameMetrics != "" {
+		renameRuleList = renameRuleListMustParse(*renameMetrics, "-rename_metrics")
+	}
+
+	var stripPrefixList []string
+	if *stripPrefixes != "" {
+		stripPrefixList = strings.Split(*stripPrefixes, ",")
+	}
+
+	var stripSuffixList []string
+	if *stripSuffixes != "" {
+		stripSuffixList = strings.Split(*stripSuffixes, ",")
+	}
+
+	var dimensionPriorityList []MatcherWithStringList
+	if *dimensionPriorities != "" {
+		dimensionPriorityList = dimensionPriorityListMustParse(*dimensionPriorities, "-dimension_priorities")
+	}
+
+	var unitOverrideList []UnitOverride
+	if *unitOverrides != "" {
+		unitOverrideList = unitOverrideListMustParse(*unitOverrides, "-unit_overrides")
+	}
+
+	var unitConversionList []UnitConversion
+	if *unitConversions != "" {
+		unitConversionList = unitConversionListMustParse(*unitConversions, "-unit_conversions")
+	}
+
+	var destinationList []Destination
+	if *destinations != "" {
+		destinationList = destinationListMustParse(*destinations, "-destinations")
+	}
+
 	config := &Config{
 		CloudWatchNamespace:           *cloudWatchNamespace,
+		NamespaceLabel:                *namespaceLabel,
+		NamespaceRules:                namespaceRuleList,
 		CloudWatchRegion:              *cloudWatchRegion,
+		Destinations:                  destinationList,
 		PrometheusScrapeUrl:           *prometheusScrapeUrl,
+		FederationMatchers:            federationMatchers,
+		FederationStripLabels:         *federationStripLabels,
+		ListenAddress:                 *listenAddress,
+		RemoteWriteReceiver:           *remoteWriteReceiver,
+		PushReceiver:                  *pushReceiver,
+		PushDeleteAfterPublish:        *pushDeleteAfterPublish,
+		OTLPReceiver:                  *otlpReceiver,
+		OTLPResourceAttributes:        resourceAttributes,
+		StatsdListenAddress:           *statsdListenAddress,
+		TextfileDirectory:             *textfileDirectory,
+		PrometheusQueryUrl:            *prometheusQueryUrl,
+		PrometheusQueries:             queries,
 		PrometheusCertPath:            *certPath,
 		PrometheusKeyPath:             *keyPath,
 		PrometheusSkipServerCertCheck: skipCertCheck,
+		PrometheusCAPath:              *caPath,
+		PrometheusServerName:          *tlsServerName,
+		PrometheusMinTLSVersion:       minTLSVersion,
+		PrometheusBearerToken:         *bearerToken,
+		PrometheusBearerTokenFile:     *bearerTokenFile,
+		PrometheusBasicAuthUsername:   *basicAuthUsername,
+		PrometheusBasicAuthPassword:   *basicAuthPassword,
+		PrometheusHeaders:             headers,
 		AwsAccessKeyId:                *awsAccessKeyId,
 		AwsSecretAccessKey:            *awsSecretAccessKey,
 		AwsSessionToken:               *awsSessionToken,
-		AdditionalDimensions:          additionalDimensions,
+		AdditionalDimensions:          dimensions,
 		ReplaceDimensions:             replaceDims,
 		IncludeMetrics:                includeMetricsList,
 		ExcludeMetrics:                excludeMetricsList,
 		ExcludeDimensionsForMetrics:   excludeDimensionsForMetricsList,
 		IncludeDimensionsForMetrics:   includeDimensionsForMetricsList,
+		PublishOnChange:               publishOnChangeList,
+		DimensionPriorities:           dimensionPriorityList,
 		ForceHighRes:                  *forceHighRes,
+		StatisticSets:                 *statisticSets,
+		RenameRules:                   renameRuleList,
+		StripPrefixes:                 stripPrefixList,
+		StripSuffixes:                 stripSuffixList,
+		PascalCaseNames:               *pascalCaseNames,
+		InferUnits:                    *inferUnits,
+		UnitOverrides:                 unitOverrideList,
+		UnitConversions:               unitConversionList,
+		HonorTimestamps:               *honorTimestamps,
 	}
 
 	if *prometheusScrapeInterval != "" {
@@ -191,6 +547,15 @@ func main() {
 		if err != nil {
 			log.Fatal("prometheus-to-cloudwatch: error parsing 'prometheus_scrape_interval': ", err)
 		}
+		config.PrometheusScrapeInterval = time.Duration(interval) * time.Second
+		config.CloudWatchPublishInterval = config.PrometheusScrapeInterval
+	}
+
+	if *cloudWatchPublishInterval != "" {
+		interval, err := strconv.Atoi(*cloudWatchPublishInterval)
+		if err != nil {
+			log.Fatal("prometheus-to-cloudwatch: error parsing 'cloudwatch_publish_interval': ", err)
+		}
 		config.CloudWatchPublishInterval = time.Duration(interval) * time.Second
 	}
 
@@ -202,12 +567,66 @@ func main() {
 		config.CloudWatchPublishTimeout = time.Duration(timeout) * time.Second
 	}
 
+	if *publishConcurrency != "" {
+		concurrency, err := strconv.Atoi(*publishConcurrency)
+		if err != nil {
+			log.Fatal("prometheus-to-cloudwatch: error parsing 'publish_concurrency': ", err)
+		}
+		config.PublishConcurrency = concurrency
+	}
+
+	if *publishRateLimit != "" {
+		limit, err := strconv.ParseFloat(*publishRateLimit, 64)
+		if err != nil {
+			log.Fatal("prometheus-to-cloudwatch: error parsing 'publish_rate_limit': ", err)
+		}
+		config.PublishRateLimit = limit
+	}
+
+	if *publishCycleTimeout != "" {
+		timeout, err := strconv.Atoi(*publishCycleTimeout)
+		if err != nil {
+			log.Fatal("prometheus-to-cloudwatch: error parsing 'publish_cycle_timeout': ", err)
+		}
+		config.PublishCycleTimeout = time.Duration(timeout) * time.Second
+	}
+
+	if *publishOnChangeHeartbeat != "" {
+		heartbeat, err := strconv.Atoi(*publishOnChangeHeartbeat)
+		if err != nil {
+			log.Fatal("prometheus-to-cloudwatch: error parsing 'publish_on_change_heartbeat': ", err)
+		}
+		config.PublishOnChangeHeartbeat = time.Duration(heartbeat) * time.Second
+	}
+
+	if *maxDimensions != "" {
+		limit, err := strconv.Atoi(*maxDimensions)
+		if err != nil {
+			log.Fatal("prometheus-to-cloudwatch: error parsing 'max_dimensions': ", err)
+		}
+		config.MaxDimensions = limit
+	}
+
+	if *maxSampleAge != "" {
+		age, err := strconv.Atoi(*maxSampleAge)
+		if err != nil {
+			log.Fatal("prometheus-to-cloudwatch: error parsing 'max_sample_age': ", err)
+		}
+		config.MaxSampleAge = time.Duration(age) * time.Second
+	}
+
 	bridge, err := NewBridge(config)
 
 	if err != nil {
 		log.Fatal("prometheus-to-cloudwatch: Error: ", err)
 	}
 
+	if runningInLambda() {
+		log.Println("prometheus-to-cloudwatch: Starting prometheus-to-cloudwatch Lambda handler")
+		runLambda(bridge)
+		return
+	}
+
 	log.Println("prometheus-to-cloudwatch: Starting prometheus-to-cloudwatch bridge")
 
 	ctx := context.Background()
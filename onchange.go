@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/prometheus/common/model"
+)
+
+// skipUnchanged reports whether the sample of a metric in publish on change mode has the value last published for
+// its series, and the heartbeat interval hasn't expired since, in which case it isn't published again.
+// The values last published for the series of the cycle are carried over in `seen`. The values of the samples that
+// are published are recorded in their batch with recordChanged, once their datum is appended
+func (b *Bridge) skipUnchanged(s *model.Sample, name string, st *statistics, now model.Time, seen map[model.Fingerprint]publishedValue) bool {
+	if !anyPatternMatches(b.publishOnChange, name) {
+		return false
+	}
+	last, ok := b.lastPublished.get(s.Metric.Fingerprint(), seen)
+
+	// Aggregated samples changed within the interval unless they all had the same value
+	return ok && last.value == s.Value && (st == nil || st.min == st.max) && now.Sub(last.at) < b.publishOnChangeHeartbeat
+}
+
+// recordChanged records the value of a sample of a metric in publish on change mode in `changed`, to be recorded as
+// published once its batch is sent
+func (b *Bridge) recordChanged(s *model.Sample, name string, now model.Time, changed map[model.Fingerprint]publishedValue) {
+	if anyPatternMatches(b.publishOnChange, name) {
+		changed[s.Metric.Fingerprint()] = publishedValue{value: s.Value, at: now}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gobwas/glob"
+	"github.com/prometheus/common/model"
+)
+
+func TestPublishOnChange(t *testing.T) {
+	up := model.Metric{model.MetricNameLabel: "up"}
+	start := model.Now()
+
+	type cycle struct {
+		// Values scraped during the cycle, aggregated into a statistic set when there are several
+		values      []model.SampleValue
+		after       time.Duration
+		wantPublish bool
+	}
+	tests := []struct {
+		name   string
+		cycles []cycle
+	}{
+		{
+			name: "changed value republished before the heartbeat",
+			cycles: []cycle{
+				{values: []model.SampleValue{1}, wantPublish: true},
+				{values: []model.SampleValue{2}, after: time.Minute, wantPublish: true},
+				{values: []model.SampleValue{2}, after: 2 * time.Minute, wantPublish: false},
+			},
+		},
+		{
+			name: "unchanged value republished once the heartbeat expired",
+			cycles: []cycle{
+				{values: []model.SampleValue{1}, wantPublish: true},
+				{values: []model.SampleValue{1}, after: 4 * time.Minute, wantPublish: false},
+				{values: []model.SampleValue{1}, after: 5 * time.Minute, wantPublish: true},
+				{values: []model.SampleValue{1}, after: 6 * time.Minute, wantPublish: false},
+			},
+		},
+		{
+			name: "statistic set with different min and max republished",
+			cycles: []cycle{
+				{values: []model.SampleValue{1}, wantPublish: true},
+				{values: []model.SampleValue{2, 1}, after: time.Minute, wantPublish: true},
+				{values: []model.SampleValue{1, 1}, after: 2 * time.Minute, wantPublish: false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cw := newFakeCloudWatch(t)
+			b := newTestBridge(t, &Config{
+				PrometheusScrapeUrl:      "http://localhost:9100/metrics",
+				PublishOnChange:          []glob.Glob{glob.MustCompile("up")},
+				PublishOnChangeHeartbeat: 5 * time.Minute,
+			}, cw)
+
+			for i, c := range tt.cycles {
+				now := start.Add(c.after)
+				for j, v := range c.values {
+					b.aggregated.add(model.Vector{{Metric: up, Value: v, Timestamp: now.Add(time.Duration(j-len(c.values)) * time.Second)}}, nil)
+				}
+				cw.reset()
+				if _, err := b.publishCollected(context.Background(), now); err != nil {
+					t.Fatal(err)
+				}
+				if got := len(cw.metricNames()) == 1; got != c.wantPublish {
+					t.Errorf("cycle %d: published = %v, want %v", i, got, c.wantPublish)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// openMetricsUnits maps OpenMetrics units (from `# UNIT` metadata) to CloudWatch units
+var openMetricsUnits = map[string]string{
+	"seconds":          "Seconds",
+	"milliseconds":     "Milliseconds",
+	"microseconds":     "Microseconds",
+	"bytes":            "Bytes",
+	"kilobytes":        "Kilobytes",
+	"megabytes":        "Megabytes",
+	"gigabytes":        "Gigabytes",
+	"terabytes":        "Terabytes",
+	"bits":             "Bits",
+	"percent":          "Percent",
+	"count":            "Count",
+	"bytes_per_second": "Bytes/Second",
+	"bits_per_second":  "Bits/Second",
+	"count_per_second": "Count/Second",
+}
+
+// openMetricsSuffixes lists the sample name suffixes allowed for each OpenMetrics metric type
+var openMetricsSuffixes = map[string][]string{
+	"counter":        {"_total", "_created"},
+	"gauge":          {""},
+	"histogram":      {"_bucket", "_count", "_sum", "_created"},
+	"gaugehistogram": {"_bucket", "_gcount", "_gsum"},
+	"summary":        {"", "_count", "_sum", "_created"},
+	"info":           {"_info"},
+	"stateset":       {""},
+	"unknown":        {""},
+}
+
+// openMetricsFamily holds the metadata of the metric family currently being parsed
+type openMetricsFamily struct {
+	name string
+	typ  string
+	help string
+	unit string
+}
+
+// openMetricsParser parses the OpenMetrics text exposition format.
+// Each sample name becomes its own MetricFamily (e.g. `foo_bucket`, `foo_count` and `foo_sum` for a histogram `foo`),
+// which matches the samples produced by expfmt.ExtractSamples for the equivalent Prometheus text format.
+// `info` and `stateset` metrics are published as gauges. `_created` samples (the creation time of counters, histograms
+// and summaries) are metadata rather than measurements, so they are dropped like exemplars.
+// Units from `# UNIT` metadata are mapped to CloudWatch units and attached with the __cw_unit label
+type openMetricsParser struct {
+	current  *openMetricsFamily
+	families map[string]*openMetricsFamily
+	result   []*dto.MetricFamily
+	byName   map[string]*dto.MetricFamily
+}
+
+// parseOpenMetrics parses an OpenMetrics text exposition into MetricFamily proto messages
+func parseOpenMetrics(r io.Reader) ([]*dto.MetricFamily, error) {
+	p := &openMetricsParser{
+		families: map[string]*openMetricsFamily{},
+		byName:   map[string]*dto.MetricFamily{},
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNum := 0
+	eof := false
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if eof {
+			return nil, fmt.Errorf("openmetrics: line %d: content after # EOF", lineNum)
+		}
+		var err error
+		switch {
+		case line == "# EOF":
+			eof = true
+		case strings.HasPrefix(line, "#"):
+			err = p.parseMetadata(line)
+		case line == "":
+			err = errors.New("empty line")
+		default:
+			err = p.parseSample(line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("openmetrics: line %d: %s", lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !eof {
+		return nil, errors.New("openmetrics: missing # EOF, exposition is truncated")
+	}
+	return p.result, nil
+}
+
+func (p *openMetricsParser) parseMetadata(line string) error {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 || fields[0] != "#" {
+		// Not a metadata line, ignore like the Prometheus text parser does with comments
+		return nil
+	}
+
+	name := fields[2]
+	var value string
+	if len(fields) == 4 {
+		value = fields[3]
+	}
+
+	f, ok := p.families[name]
+	if !ok {
+		f = &openMetricsFamily{name: name, typ: "unknown"}
+		p.families[name] = f
+	}
+	p.current = f
+
+	switch fields[1] {
+	case "TYPE":
+		if _, ok := openMetricsSuffixes[value]; !ok {
+			return fmt.Errorf("invalid metric type %q", value)
+		}
+		f.typ = value
+	case "HELP":
+		f.help = unescapeOpenMetrics(value)
+	case "UNIT":
+		f.unit = value
+	}
+	return nil
+}
+
+// familyFor returns the metadata of the family the sample belongs to.
+// Samples that don't belong to the current family are treated as untyped metrics without metadata
+func (p *openMetricsParser) familyFor(sampleName string) (*openMetricsFamily, string) {
+	if f := p.current; f != nil {
+		for _, suffix := range openMetricsSuffixes[f.typ] {
+			if sampleName == f.name+suffix {
+				return f, suffix
+			}
+		}
+	}
+	return &openMetricsFamily{name: sampleName, typ: "unknown"}, ""
+}
+
+func (p *openMetricsParser) parseSample(line string) error {
+	nameEnd := strings.IndexAny(line, "{ ")
+	if nameEnd <= 0 {
+		return fmt.Errorf("invalid sample %q", line)
+	}
+	sampleName := line[:nameEnd]
+	if !model.IsValidMetricName(model.LabelValue(sampleName)) {
+		return fmt.Errorf("invalid metric name %q", sampleName)
+	}
+	rest := line[nameEnd:]
+
+	var labels []*dto.LabelPair
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		if labels, rest, err = parseOpenMetricsLabels(rest[1:]); err != nil {
+			return err
+		}
+	}
+
+	// Exemplars are not supported by CloudWatch, drop them
+	if i := strings.Index(rest, " # "); i >= 0 {
+		rest = rest[:i]
+	}
+
+	if !strings.HasPrefix(rest, " ") {
+		return fmt.Errorf("missing value for sample %q", sampleName)
+	}
+	fields := strings.Split(rest[1:], " ")
+	if len(fields) > 2 {
+		return fmt.Errorf("unexpected content after sample %q", sampleName)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return fmt.Errorf("invalid value for sample %q: %s", sampleName, err)
+	}
+
+	metric := &dto.Metric{Label: labels}
+	if len(fields) == 2 {
+		// OpenMetrics timestamps are in seconds, Prometheus timestamps are in milliseconds
+		ts, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp for sample %q: %s", sampleName, err)
+		}
+		metric.TimestampMs = proto.Int64(int64(math.Round(ts * 1000)))
+	}
+
+	family, suffix := p.familyFor(sampleName)
+	if suffix == "_created" {
+		return nil
+	}
+	switch {
+	case suffix == "_bucket":
+		err = normalizeFloatLabel(labels, model.BucketLabel)
+	case family.typ == "summary" && suffix == "":
+		err = normalizeFloatLabel(labels, model.QuantileLabel)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid labels for sample %q: %s", sampleName, err)
+	}
+	// The family unit applies to the measured values only, not to counts of observations
+	if cwUnit, ok := openMetricsUnits[family.unit]; ok && hasUnit(suffix) && !hasLabel(labels, cwUnitLabel) {
+		metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(cwUnitLabel), Value: proto.String(cwUnit)})
+	}
+
+	typ := dto.MetricType_UNTYPED
+	switch {
+	case family.typ == "counter":
+		typ = dto.MetricType_COUNTER
+	case family.typ == "gauge", family.typ == "info", family.typ == "stateset":
+		typ = dto.MetricType_GAUGE
+	}
+
+	switch typ {
+	case dto.MetricType_COUNTER:
+		metric.Counter = &dto.Counter{Value: proto.Float64(value)}
+	case dto.MetricType_GAUGE:
+		metric.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+	default:
+		metric.Untyped = &dto.Untyped{Value: proto.Float64(value)}
+	}
+
+	mf, ok := p.byName[sampleName]
+	if !ok {
+		mf = &dto.MetricFamily{Name: proto.String(sampleName), Type: typ.Enum()}
+		if family.help != "" {
+			mf.Help = proto.String(family.help)
+		}
+		p.byName[sampleName] = mf
+		p.result = append(p.result, mf)
+	}
+	mf.Metric = append(mf.Metric, metric)
+	return nil
+}
+
+// hasUnit reports whether the samples with the suffix are in the unit of their family
+func hasUnit(suffix string) bool {
+	switch suffix {
+	case "", "_total", "_sum", "_gsum":
+		return true
+	}
+	return false
+}
+
+// parseOpenMetricsLabels parses the labels of a sample up to and including the closing brace,
+// and returns the remainder of the line
+func parseOpenMetricsLabels(s string) ([]*dto.LabelPair, string, error) {
+	var labels []*dto.LabelPair
+	for {
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+
+		eq := strings.Index(s, "=\"")
+		if eq <= 0 {
+			return nil, "", errors.New("invalid label set")
+		}
+		name := s[:eq]
+		if !model.LabelName(name).IsValid() {
+			return nil, "", fmt.Errorf("invalid label name %q", name)
+		}
+		s = s[eq+2:]
+
+		// Find the closing quote, skipping escaped characters
+		end := -1
+		for i := 0; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == '"' {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated value for label %q", name)
+		}
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(unescapeOpenMetrics(s[:end]))})
+		s = s[end+1:]
+
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return nil, "", errors.New("invalid label set")
+		}
+	}
+}
+
+// normalizeFloatLabel rewrites the value of the `le` or `quantile` label the way expfmt.ExtractSamples formats them
+// for the Prometheus text and protobuf formats (e.g. `1.0` becomes `1`), so all formats give the same dimensions
+func normalizeFloatLabel(labels []*dto.LabelPair, name string) error {
+	for _, l := range labels {
+		if l.GetName() != name {
+			continue
+		}
+		v, err := strconv.ParseFloat(l.GetValue(), 64)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for label %q", l.GetValue(), name)
+		}
+		l.Value = proto.String(fmt.Sprint(v))
+	}
+	return nil
+}
+
+// unescapeOpenMetrics replaces the escape sequences allowed in HELP texts and label values
+func unescapeOpenMetrics(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			sb.WriteByte('\n')
+		case '\\':
+			sb.WriteByte('\\')
+		case '"':
+			sb.WriteByte('"')
+		default:
+			sb.WriteByte('\\')
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+func hasLabel(labels []*dto.LabelPair, name string) bool {
+	for _, l := range labels {
+		if l.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestParseOpenMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "counter with exemplar and created",
+			input: `# TYPE http_requests counter
+# HELP http_requests Requests served.
+http_requests_total{code="200"} 1027 # {trace_id="abc"} 1 1600000000.1
+http_requests_created{code="200"} 1600000000
+# EOF
+`,
+			want: []string{
+				`http_requests_total{code="200"} => 1027 @[1]`,
+			},
+		},
+		{
+			name: "gauge with unit and timestamp in seconds",
+			input: `# TYPE process_memory_usage_bytes gauge
+# UNIT process_memory_usage_bytes bytes
+process_memory_usage_bytes 2048 1600000000.5
+# EOF
+`,
+			want: []string{
+				`process_memory_usage_bytes{__cw_unit="Bytes"} => 2048 @[1600000000.5]`,
+			},
+		},
+		{
+			name: "histogram",
+			input: `# TYPE rpc_duration_seconds histogram
+# UNIT rpc_duration_seconds seconds
+rpc_duration_seconds_bucket{le="0.1"} 3
+rpc_duration_seconds_bucket{le="+Inf"} 5 # {trace_id="def"} 0.4
+rpc_duration_seconds_count 5
+rpc_duration_seconds_sum 0.9
+# EOF
+`,
+			want: []string{
+				`rpc_duration_seconds_bucket{le="+Inf"} => 5 @[1]`,
+				`rpc_duration_seconds_bucket{le="0.1"} => 3 @[1]`,
+				`rpc_duration_seconds_count => 5 @[1]`,
+				`rpc_duration_seconds_sum{__cw_unit="Seconds"} => 0.9 @[1]`,
+			},
+		},
+		{
+			name: "info, stateset and escaped label values",
+			input: `# TYPE build info
+build_info{version="1.0",path="C:\\bin",quote="say \"hi\"\n"} 1
+# TYPE feature stateset
+feature{feature="a"} 1
+feature{feature="b"} 0
+# EOF
+`,
+			want: []string{
+				`build_info{path="C:\\bin", quote="say \"hi\"\n", version="1.0"} => 1 @[1]`,
+				`feature{feature="a"} => 1 @[1]`,
+				`feature{feature="b"} => 0 @[1]`,
+			},
+		},
+		{
+			name: "samples outside the current family are untyped",
+			input: `# TYPE a gauge
+b 1
+# EOF
+`,
+			want: []string{
+				`b => 1 @[1]`,
+			},
+		},
+		{
+			name:    "missing EOF",
+			input:   "a 1\n",
+			wantErr: "missing # EOF",
+		},
+		{
+			name:    "content after EOF",
+			input:   "a 1\n# EOF\na 2\n",
+			wantErr: "line 3: content after # EOF",
+		},
+		{
+			name:    "empty line",
+			input:   "a 1\n\n# EOF\n",
+			wantErr: "line 2: empty line",
+		},
+		{
+			name:    "invalid type",
+			input:   "# TYPE a histogram2\n# EOF\n",
+			wantErr: `invalid metric type "histogram2"`,
+		},
+		{
+			name:    "unterminated label value",
+			input:   "a{b=\"c} 1\n# EOF\n",
+			wantErr: `unterminated value for label "b"`,
+		},
+		{
+			name:    "invalid value",
+			input:   "a one\n# EOF\n",
+			wantErr: `invalid value for sample "a"`,
+		},
+		{
+			name:    "missing value",
+			input:   "a{b=\"c\"}\n# EOF\n",
+			wantErr: `missing value for sample "a"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mfs, err := parseOpenMetrics(strings.NewReader(tt.input))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			samples, err := extractSamples(mfs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stampSamples(samples, 1000, nil)
+			got := make([]string, 0, len(samples))
+			for _, s := range samples {
+				got = append(got, s.String())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseOpenMetricsHelp(t *testing.T) {
+	mfs, err := parseOpenMetrics(strings.NewReader("# TYPE a gauge\n# HELP a Line one\\nline \\\"two\\\"\na 1\n# EOF\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mfs[0].GetHelp(), "Line one\nline \"two\""; got != want {
+		t.Errorf("help = %q, want %q", got, want)
+	}
+}
+
+func TestParseOpenMetricsMatchesOtherFormats(t *testing.T) {
+	text := `# TYPE rpc_duration_seconds histogram
+rpc_duration_seconds_bucket{le="0.50"} 1
+rpc_duration_seconds_bucket{le="1.0"} 3
+rpc_duration_seconds_bucket{le="+Inf"} 5
+rpc_duration_seconds_sum 4.5
+rpc_duration_seconds_count 5
+# TYPE rpc_size_bytes summary
+rpc_size_bytes{quantile="0.50"} 128
+rpc_size_bytes{quantile="0.990"} 512
+rpc_size_bytes_sum 1024
+rpc_size_bytes_count 5
+`
+	openMetrics := text + "# EOF\n"
+
+	mfs, err := decodeMetricFamilies(string(expfmt.FmtText), strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var protobuf bytes.Buffer
+	enc := expfmt.NewEncoder(&protobuf, expfmt.FmtProtoDelim)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	samples := func(contentType, exposition string) []string {
+		mfs, err := decodeMetricFamilies(contentType, strings.NewReader(exposition))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vector, err := extractSamples(mfs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stampSamples(vector, 1000, nil)
+		got := make([]string, 0, len(vector))
+		for _, s := range vector {
+			got = append(got, s.String())
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	want := samples(string(expfmt.FmtText), text)
+	if got := samples(string(expfmt.FmtProtoDelim), protobuf.String()); !reflect.DeepEqual(got, want) {
+		t.Errorf("protobuf samples\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := samples(expfmt.OpenMetricsType+"; version=0.0.1", openMetrics); !reflect.DeepEqual(got, want) {
+		t.Errorf("OpenMetrics samples\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if !strings.Contains(strings.Join(want, "\n"), `le="1"`) || !strings.Contains(strings.Join(want, "\n"), `quantile="0.5"`) {
+		t.Errorf("expected normalized le and quantile labels, got\n%s", strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,786 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpMetricsPath is the path of the OTLP/HTTP metrics receiver
+const otlpMetricsPath = "/v1/metrics"
+
+// otlpFlagNoRecordedValue marks data points without a value
+const otlpFlagNoRecordedValue = 1
+
+// otlpTemporalityDelta is the aggregation temporality of sums and histograms whose data points hold the change since the previous
+// data point, rather than the running total
+const otlpTemporalityDelta = 1
+
+// defaultOTLPResourceAttributes are the resource attributes added as dimensions unless configured otherwise
+var defaultOTLPResourceAttributes = []string{"service.name", "service.namespace", "deployment.environment"}
+
+// otlpUnits maps OpenTelemetry (UCUM) units to CloudWatch units
+var otlpUnits = map[string]string{
+	"s":      "Seconds",
+	"ms":     "Milliseconds",
+	"us":     "Microseconds",
+	"By":     "Bytes",
+	"kBy":    "Kilobytes",
+	"MBy":    "Megabytes",
+	"GBy":    "Gigabytes",
+	"TBy":    "Terabytes",
+	"bit":    "Bits",
+	"kbit":   "Kilobits",
+	"Mbit":   "Megabits",
+	"Gbit":   "Gigabits",
+	"Tbit":   "Terabits",
+	"%":      "Percent",
+	"By/s":   "Bytes/Second",
+	"kBy/s":  "Kilobytes/Second",
+	"MBy/s":  "Megabytes/Second",
+	"GBy/s":  "Gigabytes/Second",
+	"bit/s":  "Bits/Second",
+	"kbit/s": "Kilobits/Second",
+	"Mbit/s": "Megabits/Second",
+	"Gbit/s": "Gigabits/Second",
+	"1/s":    "Count/Second",
+}
+
+// The following types hold the subset of the OTLP metrics data model published to CloudWatch.
+// They are decoded from OTLP/JSON with encoding/json and from OTLP/protobuf by the decode* functions below
+// (see https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto)
+
+type otlpExportRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	// Deprecated name of ScopeMetrics, still sent by older exporters
+	InstrumentationLibraryMetrics []otlpScopeMetrics `json:"instrumentationLibraryMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name                 string                    `json:"name"`
+	Unit                 string                    `json:"unit"`
+	Gauge                *otlpGauge                `json:"gauge"`
+	Sum                  *otlpSum                  `json:"sum"`
+	Histogram            *otlpHistogram            `json:"histogram"`
+	ExponentialHistogram *otlpExponentialHistogram `json:"exponentialHistogram"`
+	Summary              *otlpSummary              `json:"summary"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int32                 `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int32                    `json:"aggregationTemporality"`
+}
+
+type otlpExponentialHistogram struct {
+	DataPoints             []otlpExponentialHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int32                               `json:"aggregationTemporality"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes"`
+	TimeUnixNano otlpUint64     `json:"timeUnixNano"`
+	AsDouble     *otlpFloat     `json:"asDouble"`
+	AsInt        *otlpInt64     `json:"asInt"`
+	Flags        uint32         `json:"flags"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes     []otlpKeyValue `json:"attributes"`
+	TimeUnixNano   otlpUint64     `json:"timeUnixNano"`
+	Count          otlpUint64     `json:"count"`
+	Sum            *otlpFloat     `json:"sum"`
+	BucketCounts   []otlpUint64   `json:"bucketCounts"`
+	ExplicitBounds []otlpFloat    `json:"explicitBounds"`
+	Flags          uint32         `json:"flags"`
+}
+
+type otlpExponentialHistogramDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes"`
+	TimeUnixNano otlpUint64     `json:"timeUnixNano"`
+	Count        otlpUint64     `json:"count"`
+	Sum          *otlpFloat     `json:"sum"`
+	Scale        int32          `json:"scale"`
+	ZeroCount    otlpUint64     `json:"zeroCount"`
+	Positive     otlpBuckets    `json:"positive"`
+	Negative     otlpBuckets    `json:"negative"`
+	Flags        uint32         `json:"flags"`
+}
+
+type otlpBuckets struct {
+	Offset       int32        `json:"offset"`
+	BucketCounts []otlpUint64 `json:"bucketCounts"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes     []otlpKeyValue        `json:"attributes"`
+	TimeUnixNano   otlpUint64            `json:"timeUnixNano"`
+	Count          otlpUint64            `json:"count"`
+	Sum            otlpFloat             `json:"sum"`
+	QuantileValues []otlpValueAtQuantile `json:"quantileValues"`
+	Flags          uint32                `json:"flags"`
+}
+
+type otlpValueAtQuantile struct {
+	Quantile otlpFloat `json:"quantile"`
+	Value    otlpFloat `json:"value"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// otlpAnyValue holds an attribute value. Array, key-value list and bytes values are not supported as dimensions and are ignored
+type otlpAnyValue struct {
+	StringValue *string    `json:"stringValue"`
+	BoolValue   *bool      `json:"boolValue"`
+	IntValue    *otlpInt64 `json:"intValue"`
+	DoubleValue *otlpFloat `json:"doubleValue"`
+}
+
+// String returns the attribute value as a label value, and false if the value type is not supported
+func (v otlpAnyValue) String() (string, bool) {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue, true
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue), true
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10), true
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(float64(*v.DoubleValue), 'g', -1, 64), true
+	}
+	return "", false
+}
+
+// otlpUint64 is a uint64 encoded as a JSON string or number
+type otlpUint64 uint64
+
+func (u *otlpUint64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseUint(strings.Trim(string(b), `"`), 10, 64)
+	*u = otlpUint64(v)
+	return err
+}
+
+// otlpInt64 is an int64 encoded as a JSON string or number
+type otlpInt64 int64
+
+func (i *otlpInt64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	*i = otlpInt64(v)
+	return err
+}
+
+// otlpFloat is a float64 encoded as a JSON number, or as a string for special values (e.g. "NaN", "Infinity")
+type otlpFloat float64
+
+func (f *otlpFloat) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "Infinity" {
+		s = "+Inf"
+	} else if s == "-Infinity" {
+		s = "-Inf"
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	*f = otlpFloat(v)
+	return err
+}
+
+// handleOTLP accepts OTLP/HTTP metric exports encoded as protobuf or JSON.
+// The received data points are converted to samples and published on the next cycle
+func (b *Bridge) handleOTLP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body io.ReadCloser = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		// The decompressed body is limited too
+		body = http.MaxBytesReader(w, zr, maxRequestBodySize)
+	}
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var req otlpExportRequest
+	switch mediaType {
+	case "application/x-protobuf":
+		err = decodeOTLPExportRequest(buf, &req)
+	case "application/json":
+		err = json.Unmarshal(buf, &req)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported content type %q", mediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("decoding request failed: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	samples, deltas := b.otlpSamples(&req)
+	for _, s := range samples {
+		if b.shouldIgnoreMetric(getName(s.Metric)) {
+			continue
+		}
+		b.receive(s)
+	}
+	for _, s := range deltas {
+		if b.shouldIgnoreMetric(getName(s.Metric)) {
+			continue
+		}
+		b.receiveDelta(s)
+	}
+
+	// An empty ExportMetricsServiceResponse
+	w.Header().Set("Content-Type", mediaType)
+	if mediaType == "application/json" {
+		_, _ = w.Write([]byte("{}"))
+	}
+}
+
+// otlpSamples converts the data points of the request into samples, following the naming conventions of the
+// OpenTelemetry Prometheus exporter: monotonic cumulative sums get a `_total` suffix, histograms and summaries are split
+// into `_bucket`, `_count` and `_sum` (and quantile) series. Resource attributes are added as labels,
+// restricted to the configured list unless all of them are. The data points of delta sums and histograms are returned separately, as they are
+// added up until the next publish cycle rather than replacing each other
+func (b *Bridge) otlpSamples(req *otlpExportRequest) (model.Vector, model.Vector) {
+	var vec, deltas model.Vector
+	for _, rm := range req.ResourceMetrics {
+		resourceLabels := model.Metric{}
+		for _, kv := range rm.Resource.Attributes {
+			if b.otlpResourceAttributes != nil && !b.otlpResourceAttributes[kv.Key] {
+				continue
+			}
+			if v, ok := kv.Value.String(); ok {
+				resourceLabels[sanitizeLabelName(kv.Key)] = model.LabelValue(v)
+			}
+		}
+
+		for _, sm := range append(rm.ScopeMetrics, rm.InstrumentationLibraryMetrics...) {
+			for _, m := range sm.Metrics {
+				if m.isDelta() {
+					deltas = append(deltas, otlpMetricSamples(m, resourceLabels)...)
+				} else {
+					vec = append(vec, otlpMetricSamples(m, resourceLabels)...)
+				}
+			}
+		}
+	}
+	return vec, deltas
+}
+
+// isDelta reports whether the data points of the metric hold the change since the previous data point
+func (m otlpMetric) isDelta() bool {
+	switch {
+	case m.Sum != nil:
+		return m.Sum.AggregationTemporality == otlpTemporalityDelta
+	case m.Histogram != nil:
+		return m.Histogram.AggregationTemporality == otlpTemporalityDelta
+	case m.ExponentialHistogram != nil:
+		return m.ExponentialHistogram.AggregationTemporality == otlpTemporalityDelta
+	}
+	return false
+}
+
+func otlpMetricSamples(m otlpMetric, resourceLabels model.Metric) model.Vector {
+	name := sanitizeMetricName(m.Name)
+	if name == "" {
+		return nil
+	}
+
+	var vec model.Vector
+	add := func(suffix string, attrs []otlpKeyValue, ts otlpUint64, value float64, extra model.LabelSet) {
+		metric := model.Metric{}
+		for k, v := range resourceLabels {
+			metric[k] = v
+		}
+		for _, kv := range attrs {
+			if v, ok := kv.Value.String(); ok {
+				metric[sanitizeLabelName(kv.Key)] = model.LabelValue(v)
+			}
+		}
+		for k, v := range extra {
+			metric[k] = v
+		}
+		metric[model.MetricNameLabel] = model.LabelValue(name + suffix)
+		if unit, ok := otlpCloudWatchUnit(m.Unit); ok && (suffix == "" || suffix == "_total" || suffix == "_sum") {
+			metric[cwUnitLabel] = model.LabelValue(unit)
+		}
+		vec = append(vec, &model.Sample{
+			Metric:    metric,
+			Value:     model.SampleValue(value),
+			Timestamp: model.TimeFromUnixNano(int64(ts)),
+		})
+	}
+
+	numberValue := func(dp otlpNumberDataPoint) float64 {
+		if dp.AsInt != nil {
+			return float64(*dp.AsInt)
+		}
+		if dp.AsDouble != nil {
+			return float64(*dp.AsDouble)
+		}
+		return 0
+	}
+
+	switch {
+	case m.Gauge != nil:
+		for _, dp := range m.Gauge.DataPoints {
+			if dp.Flags&otlpFlagNoRecordedValue == 0 {
+				add("", dp.Attributes, dp.TimeUnixNano, numberValue(dp), nil)
+			}
+		}
+	case m.Sum != nil:
+		// Delta sums are published as the increase over the publish interval, not as a counter
+		suffix := ""
+		if m.Sum.IsMonotonic && m.Sum.AggregationTemporality != otlpTemporalityDelta && !strings.HasSuffix(name, "_total") {
+			suffix = "_total"
+		}
+		for _, dp := range m.Sum.DataPoints {
+			if dp.Flags&otlpFlagNoRecordedValue == 0 {
+				add(suffix, dp.Attributes, dp.TimeUnixNano, numberValue(dp), nil)
+			}
+		}
+	case m.Histogram != nil:
+		for _, dp := range m.Histogram.DataPoints {
+			if dp.Flags&otlpFlagNoRecordedValue != 0 {
+				continue
+			}
+			var cumulative uint64
+			for i, count := range dp.BucketCounts {
+				cumulative += uint64(count)
+				le := "+Inf"
+				if i < len(dp.ExplicitBounds) {
+					le = model.SampleValue(dp.ExplicitBounds[i]).String()
+				}
+				add("_bucket", dp.Attributes, dp.TimeUnixNano, float64(cumulative), model.LabelSet{model.BucketLabel: model.LabelValue(le)})
+			}
+			add("_count", dp.Attributes, dp.TimeUnixNano, float64(dp.Count), nil)
+			if dp.Sum != nil {
+				add("_sum", dp.Attributes, dp.TimeUnixNano, float64(*dp.Sum), nil)
+			}
+		}
+	case m.ExponentialHistogram != nil:
+		for _, dp := range m.ExponentialHistogram.DataPoints {
+			if dp.Flags&otlpFlagNoRecordedValue != 0 {
+				continue
+			}
+			// Negative and zero observations are counted in the first positive bucket
+			cumulative := uint64(dp.ZeroCount)
+			for _, count := range dp.Negative.BucketCounts {
+				cumulative += uint64(count)
+			}
+			base := math.Pow(2, math.Pow(2, -float64(dp.Scale)))
+			for i, count := range dp.Positive.BucketCounts {
+				cumulative += uint64(count)
+				le := math.Pow(base, float64(int(dp.Positive.Offset)+i+1))
+				add("_bucket", dp.Attributes, dp.TimeUnixNano, float64(cumulative), model.LabelSet{model.BucketLabel: model.LabelValue(model.SampleValue(le).String())})
+			}
+			add("_bucket", dp.Attributes, dp.TimeUnixNano, float64(dp.Count), model.LabelSet{model.BucketLabel: "+Inf"})
+			add("_count", dp.Attributes, dp.TimeUnixNano, float64(dp.Count), nil)
+			if dp.Sum != nil {
+				add("_sum", dp.Attributes, dp.TimeUnixNano, float64(*dp.Sum), nil)
+			}
+		}
+	case m.Summary != nil:
+		for _, dp := range m.Summary.DataPoints {
+			if dp.Flags&otlpFlagNoRecordedValue != 0 {
+				continue
+			}
+			for _, q := range dp.QuantileValues {
+				add("", dp.Attributes, dp.TimeUnixNano, float64(q.Value), model.LabelSet{model.QuantileLabel: model.LabelValue(model.SampleValue(q.Quantile).String())})
+			}
+			add("_count", dp.Attributes, dp.TimeUnixNano, float64(dp.Count), nil)
+			add("_sum", dp.Attributes, dp.TimeUnixNano, float64(dp.Sum), nil)
+		}
+	}
+	return vec
+}
+
+// otlpCloudWatchUnit maps a UCUM unit to a CloudWatch unit. Annotations (e.g. `{requests}`) are counts
+func otlpCloudWatchUnit(unit string) (string, bool) {
+	if strings.HasPrefix(unit, "{") && strings.HasSuffix(unit, "}") {
+		return "Count", true
+	}
+	u, ok := otlpUnits[unit]
+	return u, ok
+}
+
+// decodeOTLPExportRequest decodes an ExportMetricsServiceRequest protobuf message
+func decodeOTLPExportRequest(buf []byte, req *otlpExportRequest) error {
+	return decodeMessage(buf, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		var rm otlpResourceMetrics
+		err := decodeMessage(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+			if typ != protowire.BytesType {
+				return nil
+			}
+			switch num {
+			case 1:
+				return decodeMessage(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+					if num == 1 && typ == protowire.BytesType {
+						kv, err := decodeOTLPKeyValue(value)
+						rm.Resource.Attributes = append(rm.Resource.Attributes, kv)
+						return err
+					}
+					return nil
+				})
+			case 2, 1000:
+				var sm otlpScopeMetrics
+				err := decodeMessage(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+					if num == 2 && typ == protowire.BytesType {
+						m, err := decodeOTLPMetric(value)
+						sm.Metrics = append(sm.Metrics, m)
+						return err
+					}
+					return nil
+				})
+				rm.ScopeMetrics = append(rm.ScopeMetrics, sm)
+				return err
+			}
+			return nil
+		})
+		req.ResourceMetrics = append(req.ResourceMetrics, rm)
+		return err
+	})
+}
+
+func decodeOTLPMetric(buf []byte) (otlpMetric, error) {
+	var m otlpMetric
+	err := decodeMessage(buf, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			m.Name = string(value)
+		case 3:
+			m.Unit = string(value)
+		case 5:
+			m.Gauge = &otlpGauge{}
+			return decodeDataPoints(value, func(value []byte) error {
+				dp, err := decodeOTLPNumberDataPoint(value)
+				m.Gauge.DataPoints = append(m.Gauge.DataPoints, dp)
+				return err
+			}, nil)
+		case 7:
+			m.Sum = &otlpSum{}
+			return decodeDataPoints(value, func(value []byte) error {
+				dp, err := decodeOTLPNumberDataPoint(value)
+				m.Sum.DataPoints = append(m.Sum.DataPoints, dp)
+				return err
+			}, func(num protowire.Number, v uint64) {
+				switch num {
+				case 2:
+					m.Sum.AggregationTemporality = int32(v)
+				case 3:
+					m.Sum.IsMonotonic = v != 0
+				}
+			})
+		case 9:
+			m.Histogram = &otlpHistogram{}
+			return decodeDataPoints(value, func(value []byte) error {
+				dp, err := decodeOTLPHistogramDataPoint(value)
+				m.Histogram.DataPoints = append(m.Histogram.DataPoints, dp)
+				return err
+			}, func(num protowire.Number, v uint64) {
+				if num == 2 {
+					m.Histogram.AggregationTemporality = int32(v)
+				}
+			})
+		case 10:
+			m.ExponentialHistogram = &otlpExponentialHistogram{}
+			return decodeDataPoints(value, func(value []byte) error {
+				dp, err := decodeOTLPExponentialHistogramDataPoint(value)
+				m.ExponentialHistogram.DataPoints = append(m.ExponentialHistogram.DataPoints, dp)
+				return err
+			}, func(num protowire.Number, v uint64) {
+				if num == 2 {
+					m.ExponentialHistogram.AggregationTemporality = int32(v)
+				}
+			})
+		case 11:
+			m.Summary = &otlpSummary{}
+			return decodeDataPoints(value, func(value []byte) error {
+				dp, err := decodeOTLPSummaryDataPoint(value)
+				m.Summary.DataPoints = append(m.Summary.DataPoints, dp)
+				return err
+			}, nil)
+		}
+		return nil
+	})
+	return m, err
+}
+
+// decodeDataPoints calls dataPoint for each data point (field 1) of a Gauge, Sum, Histogram, ExponentialHistogram
+// or Summary message, and varint for its other varint fields
+func decodeDataPoints(buf []byte, dataPoint func([]byte) error, varint func(protowire.Number, uint64)) error {
+	return decodeMessage(buf, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num == 1 && typ == protowire.BytesType {
+			return dataPoint(value)
+		}
+		if typ == protowire.VarintType && varint != nil {
+			v, _ := protowire.ConsumeVarint(value)
+			varint(num, v)
+		}
+		return nil
+	})
+}
+
+func decodeOTLPNumberDataPoint(buf []byte) (otlpNumberDataPoint, error) {
+	var dp otlpNumberDataPoint
+	err := decodeMessage(buf, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 7 && typ == protowire.BytesType:
+			kv, err := decodeOTLPKeyValue(value)
+			dp.Attributes = append(dp.Attributes, kv)
+			return err
+		case num == 3 && typ == protowire.Fixed64Type:
+			dp.TimeUnixNano = otlpUint64(fixed64(value))
+		case num == 4 && typ == protowire.Fixed64Type:
+			v := otlpFloat(math.Float64frombits(fixed64(value)))
+			dp.AsDouble = &v
+		case num == 6 && typ == protowire.Fixed64Type:
+			v := otlpInt64(int64(fixed64(value)))
+			dp.AsInt = &v
+		case num == 8 && typ == protowire.VarintType:
+			dp.Flags = uint32(varint(value))
+		}
+		return nil
+	})
+	return dp, err
+}
+
+func decodeOTLPHistogramDataPoint(buf []byte) (otlpHistogramDataPoint, error) {
+	var dp otlpHistogramDataPoint
+	err := decodeMessage(buf, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 9 && typ == protowire.BytesType:
+			kv, err := decodeOTLPKeyValue(value)
+			dp.Attributes = append(dp.Attributes, kv)
+			return err
+		case num == 3 && typ == protowire.Fixed64Type:
+			dp.TimeUnixNano = otlpUint64(fixed64(value))
+		case num == 4 && typ == protowire.Fixed64Type:
+			dp.Count = otlpUint64(fixed64(value))
+		case num == 5 && typ == protowire.Fixed64Type:
+			v := otlpFloat(math.Float64frombits(fixed64(value)))
+			dp.Sum = &v
+		case num == 6:
+			return repeatedFixed64(typ, value, func(v uint64) {
+				dp.BucketCounts = append(dp.BucketCounts, otlpUint64(v))
+			})
+		case num == 7:
+			return repeatedFixed64(typ, value, func(v uint64) {
+				dp.ExplicitBounds = append(dp.ExplicitBounds, otlpFloat(math.Float64frombits(v)))
+			})
+		case num == 10 && typ == protowire.VarintType:
+			dp.Flags = uint32(varint(value))
+		}
+		return nil
+	})
+	return dp, err
+}
+
+func decodeOTLPExponentialHistogramDataPoint(buf []byte) (otlpExponentialHistogramDataPoint, error) {
+	var dp otlpExponentialHistogramDataPoint
+	err := decodeMessage(buf, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			kv, err := decodeOTLPKeyValue(value)
+			dp.Attributes = append(dp.Attributes, kv)
+			return err
+		case num == 3 && typ == protowire.Fixed64Type:
+			dp.TimeUnixNano = otlpUint64(fixed64(value))
+		case num == 4 && typ == protowire.Fixed64Type:
+			dp.Count = otlpUint64(fixed64(value))
+		case num == 5 && typ == protowire.Fixed64Type:
+			v := otlpFloat(math.Float64frombits(fixed64(value)))
+			dp.Sum = &v
+		case num == 6 && typ == protowire.VarintType:
+			dp.Scale = int32(protowire.DecodeZigZag(varint(value)))
+		case num == 7 && typ == protowire.Fixed64Type:
+			dp.ZeroCount = otlpUint64(fixed64(value))
+		case (num == 8 || num == 9) && typ == protowire.BytesType:
+			buckets, err := decodeOTLPBuckets(value)
+			if num == 8 {
+				dp.Positive = buckets
+			} else {
+				dp.Negative = buckets
+			}
+			return err
+		case num == 10 && typ == protowire.VarintType:
+			dp.Flags = uint32(varint(value))
+		}
+		return nil
+	})
+	return dp, err
+}
+
+func decodeOTLPBuckets(buf []byte) (otlpBuckets, error) {
+	var buckets otlpBuckets
+	err := decodeMessage(buf, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			buckets.Offset = int32(protowire.DecodeZigZag(varint(value)))
+		case num == 2 && typ == protowire.VarintType:
+			buckets.BucketCounts = append(buckets.BucketCounts, otlpUint64(varint(value)))
+		case num == 2 && typ == protowire.BytesType:
+			for len(value) > 0 {
+				v, n := protowire.ConsumeVarint(value)
+				if n < 0 {
+					return protowire.ParseError(n)
+				}
+				buckets.BucketCounts = append(buckets.BucketCounts, otlpUint64(v))
+				value = value[n:]
+			}
+		}
+		return nil
+	})
+	return buckets, err
+}
+
+func decodeOTLPSummaryDataPoint(buf []byte) (otlpSummaryDataPoint, error) {
+	var dp otlpSummaryDataPoint
+	err := decodeMessage(buf, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 7 && typ == protowire.BytesType:
+			kv, err := decodeOTLPKeyValue(value)
+			dp.Attributes = append(dp.Attributes, kv)
+			return err
+		case num == 3 && typ == protowire.Fixed64Type:
+			dp.TimeUnixNano = otlpUint64(fixed64(value))
+		case num == 4 && typ == protowire.Fixed64Type:
+			dp.Count = otlpUint64(fixed64(value))
+		case num == 5 && typ == protowire.Fixed64Type:
+			dp.Sum = otlpFloat(math.Float64frombits(fixed64(value)))
+		case num == 6 && typ == protowire.BytesType:
+			var q otlpValueAtQuantile
+			err := decodeMessage(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				if typ == protowire.Fixed64Type && num == 1 {
+					q.Quantile = otlpFloat(math.Float64frombits(fixed64(value)))
+				} else if typ == protowire.Fixed64Type && num == 2 {
+					q.Value = otlpFloat(math.Float64frombits(fixed64(value)))
+				}
+				return nil
+			})
+			dp.QuantileValues = append(dp.QuantileValues, q)
+			return err
+		case num == 8 && typ == protowire.VarintType:
+			dp.Flags = uint32(varint(value))
+		}
+		return nil
+	})
+	return dp, err
+}
+
+func decodeOTLPKeyValue(buf []byte) (otlpKeyValue, error) {
+	var kv otlpKeyValue
+	err := decodeMessage(buf, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		if num == 1 {
+			kv.Key = string(value)
+			return nil
+		}
+		if num != 2 {
+			return nil
+		}
+		return decodeMessage(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				s := string(value)
+				kv.Value.StringValue = &s
+			case num == 2 && typ == protowire.VarintType:
+				b := varint(value) != 0
+				kv.Value.BoolValue = &b
+			case num == 3 && typ == protowire.VarintType:
+				i := otlpInt64(int64(varint(value)))
+				kv.Value.IntValue = &i
+			case num == 4 && typ == protowire.Fixed64Type:
+				f := otlpFloat(math.Float64frombits(fixed64(value)))
+				kv.Value.DoubleValue = &f
+			}
+			return nil
+		})
+	})
+	return kv, err
+}
+
+// repeatedFixed64 calls fn for each value of a repeated fixed64 or double field, packed or not
+func repeatedFixed64(typ protowire.Type, value []byte, fn func(uint64)) error {
+	switch typ {
+	case protowire.Fixed64Type:
+		fn(fixed64(value))
+	case protowire.BytesType:
+		for len(value) > 0 {
+			v, n := protowire.ConsumeFixed64(value)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(v)
+			value = value[n:]
+		}
+	}
+	return nil
+}
+
+func fixed64(value []byte) uint64 {
+	v, _ := protowire.ConsumeFixed64(value)
+	return v
+}
+
+func varint(value []byte) uint64 {
+	v, _ := protowire.ConsumeVarint(value)
+	return v
+}
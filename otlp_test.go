@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpTime is the timestamp of the data points of the tests, 1600000000 in seconds
+const otlpTime = 1600000000000000000
+
+func pbFixed64(num protowire.Number, v uint64) []byte {
+	b := protowire.AppendTag(nil, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+// pbPackedFixed64 encodes a packed repeated fixed64 field
+func pbPackedFixed64(num protowire.Number, values ...uint64) []byte {
+	var b []byte
+	for _, v := range values {
+		b = protowire.AppendFixed64(b, v)
+	}
+	return pbMessage(num, b)
+}
+
+// pbPackedVarint encodes a packed repeated varint field
+func pbPackedVarint(num protowire.Number, values ...uint64) []byte {
+	var b []byte
+	for _, v := range values {
+		b = protowire.AppendVarint(b, v)
+	}
+	return pbMessage(num, b)
+}
+
+func otlpAttribute(num protowire.Number, key, value string) []byte {
+	return pbMessage(num, pbString(1, key), pbMessage(2, pbString(1, value)))
+}
+
+// otlpRequest encodes an ExportMetricsServiceRequest with one resource, and the metrics in one scope
+func otlpRequest(metrics ...[]byte) []byte {
+	return pbMessage(1,
+		pbMessage(1, otlpAttribute(1, "service.name", "svc")),
+		pbMessage(2, metrics...),
+	)
+}
+
+func otlpMetricField(name, unit string, data []byte) []byte {
+	return pbMessage(2, pbString(1, name), pbString(3, unit), data)
+}
+
+func TestDecodeOTLPExportRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      []byte
+		want       []string
+		wantDeltas []string
+		wantErr    bool
+	}{
+		{
+			name: "gauge",
+			input: otlpRequest(otlpMetricField("process.cpu.time", "s", pbMessage(5,
+				pbMessage(1, otlpAttribute(7, "host", "a"), pbFixed64(3, otlpTime), pbDouble(4, 1.5)),
+			))),
+			want: []string{`process_cpu_time{__cw_unit="Seconds", host="a", service_name="svc"} => 1.5 @[1600000000]`},
+		},
+		{
+			name: "cumulative monotonic sum",
+			input: otlpRequest(otlpMetricField("requests", "{requests}", pbMessage(7,
+				pbMessage(1, pbFixed64(3, otlpTime), pbFixed64(6, 7)),
+				pbVarint(2, 2),
+				pbVarint(3, 1),
+			))),
+			want: []string{`requests_total{__cw_unit="Count", service_name="svc"} => 7 @[1600000000]`},
+		},
+		{
+			name: "delta sum",
+			input: otlpRequest(otlpMetricField("requests", "", pbMessage(7,
+				pbMessage(1, pbFixed64(3, otlpTime), pbFixed64(6, 3)),
+				pbVarint(2, otlpTemporalityDelta),
+				pbVarint(3, 1),
+			))),
+			wantDeltas: []string{`requests{service_name="svc"} => 3 @[1600000000]`},
+		},
+		{
+			name: "non-monotonic sum",
+			input: otlpRequest(otlpMetricField("queue.size", "", pbMessage(7,
+				pbMessage(1, pbFixed64(3, otlpTime), pbDouble(4, 4)),
+				pbVarint(2, 2),
+			))),
+			want: []string{`queue_size{service_name="svc"} => 4 @[1600000000]`},
+		},
+		{
+			name: "no recorded value",
+			input: otlpRequest(otlpMetricField("up", "", pbMessage(5,
+				pbMessage(1, pbFixed64(3, otlpTime), pbDouble(4, 1), pbVarint(8, otlpFlagNoRecordedValue)),
+			))),
+		},
+		{
+			name: "histogram with packed repeated fields",
+			input: otlpRequest(otlpMetricField("latency", "ms", pbMessage(9,
+				pbMessage(1,
+					pbFixed64(3, otlpTime),
+					pbFixed64(4, 5),
+					pbDouble(5, 120),
+					pbPackedFixed64(6, 1, 3, 1),
+					pbPackedFixed64(7, math.Float64bits(10), math.Float64bits(100)),
+				),
+			))),
+			want: []string{
+				`latency_bucket{le="+Inf", service_name="svc"} => 5 @[1600000000]`,
+				`latency_bucket{le="10", service_name="svc"} => 1 @[1600000000]`,
+				`latency_bucket{le="100", service_name="svc"} => 4 @[1600000000]`,
+				`latency_count{service_name="svc"} => 5 @[1600000000]`,
+				`latency_sum{__cw_unit="Milliseconds", service_name="svc"} => 120 @[1600000000]`,
+			},
+		},
+		{
+			name: "histogram with unpacked repeated fields",
+			input: otlpRequest(otlpMetricField("latency", "ms", pbMessage(9,
+				pbMessage(1,
+					pbFixed64(3, otlpTime),
+					pbFixed64(4, 5),
+					pbDouble(5, 120),
+					pbFixed64(6, 1), pbFixed64(6, 3), pbFixed64(6, 1),
+					pbDouble(7, 10), pbDouble(7, 100),
+				),
+			))),
+			want: []string{
+				`latency_bucket{le="+Inf", service_name="svc"} => 5 @[1600000000]`,
+				`latency_bucket{le="10", service_name="svc"} => 1 @[1600000000]`,
+				`latency_bucket{le="100", service_name="svc"} => 4 @[1600000000]`,
+				`latency_count{service_name="svc"} => 5 @[1600000000]`,
+				`latency_sum{__cw_unit="Milliseconds", service_name="svc"} => 120 @[1600000000]`,
+			},
+		},
+		{
+			name: "delta histograms",
+			input: otlpRequest(
+				otlpMetricField("latency", "", pbMessage(9,
+					pbMessage(1, pbFixed64(3, otlpTime), pbFixed64(4, 2), pbDouble(5, 30), pbPackedFixed64(6, 2)),
+					pbVarint(2, otlpTemporalityDelta),
+				)),
+				otlpMetricField("size", "", pbMessage(10,
+					pbMessage(1, pbFixed64(3, otlpTime), pbFixed64(4, 1), pbDouble(5, 4)),
+					pbVarint(2, otlpTemporalityDelta),
+				)),
+			),
+			wantDeltas: []string{
+				`latency_bucket{le="+Inf", service_name="svc"} => 2 @[1600000000]`,
+				`latency_count{service_name="svc"} => 2 @[1600000000]`,
+				`latency_sum{service_name="svc"} => 30 @[1600000000]`,
+				`size_bucket{le="+Inf", service_name="svc"} => 1 @[1600000000]`,
+				`size_count{service_name="svc"} => 1 @[1600000000]`,
+				`size_sum{service_name="svc"} => 4 @[1600000000]`,
+			},
+		},
+		{
+			name: "exponential histogram with packed and unpacked bucket counts",
+			input: otlpRequest(
+				otlpMetricField("packed", "", pbMessage(10,
+					pbMessage(1,
+						pbFixed64(3, otlpTime),
+						pbFixed64(4, 4),
+						pbVarint(6, protowire.EncodeZigZag(0)),
+						pbFixed64(7, 1),
+						pbMessage(8, pbVarint(1, protowire.EncodeZigZag(0)), pbPackedVarint(2, 1, 2)),
+					),
+				)),
+				otlpMetricField("unpacked", "", pbMessage(10,
+					pbMessage(1,
+						pbFixed64(3, otlpTime),
+						pbFixed64(4, 4),
+						pbVarint(6, protowire.EncodeZigZag(0)),
+						pbFixed64(7, 1),
+						pbMessage(8, pbVarint(1, protowire.EncodeZigZag(0)), pbVarint(2, 1), pbVarint(2, 2)),
+					),
+				)),
+			),
+			want: []string{
+				`packed_bucket{le="+Inf", service_name="svc"} => 4 @[1600000000]`,
+				`packed_bucket{le="2", service_name="svc"} => 2 @[1600000000]`,
+				`packed_bucket{le="4", service_name="svc"} => 4 @[1600000000]`,
+				`packed_count{service_name="svc"} => 4 @[1600000000]`,
+				`unpacked_bucket{le="+Inf", service_name="svc"} => 4 @[1600000000]`,
+				`unpacked_bucket{le="2", service_name="svc"} => 2 @[1600000000]`,
+				`unpacked_bucket{le="4", service_name="svc"} => 4 @[1600000000]`,
+				`unpacked_count{service_name="svc"} => 4 @[1600000000]`,
+			},
+		},
+		{
+			name: "summary",
+			input: otlpRequest(otlpMetricField("rpc", "", pbMessage(11,
+				pbMessage(1,
+					pbFixed64(3, otlpTime),
+					pbFixed64(4, 10),
+					pbDouble(5, 25),
+					pbMessage(6, pbDouble(1, 0.5), pbDouble(2, 2)),
+					pbMessage(6, pbDouble(1, 0.99), pbDouble(2, 9)),
+				),
+			))),
+			want: []string{
+				`rpc_count{service_name="svc"} => 10 @[1600000000]`,
+				`rpc_sum{service_name="svc"} => 25 @[1600000000]`,
+				`rpc{quantile="0.5", service_name="svc"} => 2 @[1600000000]`,
+				`rpc{quantile="0.99", service_name="svc"} => 9 @[1600000000]`,
+			},
+		},
+		{
+			name: "deprecated instrumentation library metrics",
+			input: pbMessage(1, pbMessage(1000, otlpMetricField("up", "", pbMessage(5,
+				pbMessage(1, pbFixed64(3, otlpTime), pbDouble(4, 1)),
+			)))),
+			want: []string{`up => 1 @[1600000000]`},
+		},
+		{
+			name: "unknown fields skipped",
+			input: otlpRequest(otlpMetricField("up", "", pbMessage(5,
+				pbMessage(1, pbFixed64(3, otlpTime), pbDouble(4, 1), pbMessage(5, pbDouble(3, 1)), pbFixed32(99, 1)),
+			)), pbString(4, "description")),
+			want: []string{`up{service_name="svc"} => 1 @[1600000000]`},
+		},
+		{
+			name:    "truncated message",
+			input:   otlpRequest(otlpMetricField("up", "", nil))[:10],
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req otlpExportRequest
+			err := decodeOTLPExportRequest(tt.input, &req)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("decoding succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b := &Bridge{otlpResourceAttributes: stringSliceToSet(defaultOTLPResourceAttributes)}
+			samples, deltas := b.otlpSamples(&req)
+			if got := formatSamples(samples); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if got := formatSamples(deltas); !reflect.DeepEqual(got, tt.wantDeltas) {
+				t.Errorf("got deltas\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.wantDeltas, "\n"))
+			}
+		})
+	}
+}
+
+func TestDecodeOTLPJSON(t *testing.T) {
+	input := `{"resourceMetrics":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"svc"}}]},"scopeMetrics":[{"metrics":[
+		{"name":"requests","sum":{"aggregationTemporality":1,"isMonotonic":true,"dataPoints":[{"asInt":"3","timeUnixNano":"1600000000000000000"}]}},
+		{"name":"up","gauge":{"dataPoints":[{"asDouble":1,"timeUnixNano":"1600000000000000000"}]}}
+	]}]}]}`
+	var req otlpExportRequest
+	if err := json.Unmarshal([]byte(input), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Bridge{otlpResourceAttributes: stringSliceToSet(defaultOTLPResourceAttributes)}
+	samples, deltas := b.otlpSamples(&req)
+	if got, want := formatSamples(samples), []string{`up{service_name="svc"} => 1 @[1600000000]`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := formatSamples(deltas), []string{`requests{service_name="svc"} => 3 @[1600000000]`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got deltas %v, want %v", got, want)
+	}
+}
+
+func TestHandleOTLPDeltaSums(t *testing.T) {
+	b := &Bridge{received: newSampleBuffer(), otlpResourceAttributes: stringSliceToSet(defaultOTLPResourceAttributes)}
+	for _, value := range []uint64{3, 4} {
+		body := otlpRequest(otlpMetricField("requests", "", pbMessage(7,
+			pbMessage(1, pbFixed64(3, otlpTime), pbFixed64(6, value)),
+			pbVarint(2, otlpTemporalityDelta),
+			pbVarint(3, 1),
+		)))
+		r := httptest.NewRequest(http.MethodPost, otlpMetricsPath, bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-protobuf")
+		rec := httptest.NewRecorder()
+		b.handleOTLP(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	if got, want := formatSamples(b.received.drain()), []string{`requests{service_name="svc"} => 7 @[1600000000]`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("received %v, want the sum of the deltas %v", got, want)
+	}
+}
+
+// formatSamples formats the samples like the Prometheus text format, sorted, or nil if there are none
+func formatSamples(vec model.Vector) []string {
+	var s []string
+	for _, sample := range vec {
+		s = append(s, sample.String())
+	}
+	sort.Strings(s)
+	return s
+}
+
+func TestOTLPResourceAttributes(t *testing.T) {
+	input := `{"resourceMetrics":[{"resource":{"attributes":[
+		{"key":"service.name","value":{"stringValue":"svc"}},
+		{"key":"deployment.environment","value":{"stringValue":"prod"}},
+		{"key":"host.name","value":{"stringValue":"web-1"}}
+	]},"scopeMetrics":[{"metrics":[{"name":"up","gauge":{"dataPoints":[{"asDouble":1,"timeUnixNano":"1600000000000000000"}]}}]}]}]}`
+	var req otlpExportRequest
+	if err := json.Unmarshal([]byte(input), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		attributes []string
+		want       string
+	}{
+		{"default", nil, `up{deployment_environment="prod", service_name="svc"} => 1 @[1600000000]`},
+		{"configured", []string{"host.name"}, `up{host_name="web-1"} => 1 @[1600000000]`},
+		{"all", []string{"*"}, `up{deployment_environment="prod", host_name="web-1", service_name="svc"} => 1 @[1600000000]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewBridge(&Config{CloudWatchNamespace: "test", CloudWatchRegion: "us-east-1", OTLPReceiver: true, OTLPResourceAttributes: tt.attributes})
+			if err != nil {
+				t.Fatal(err)
+			}
+			samples, _ := b.otlpSamples(&req)
+			if got := formatSamples(samples); !reflect.DeepEqual(got, []string{tt.want}) {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,15 +5,24 @@ import (
 	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"mime"
 	"net/http"
+	"os"
+	"regexp"
 	"sort"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -31,7 +40,14 @@ const (
 	batchSize      = 10
 	cwHighResLabel = "__cw_high_res"
 	cwUnitLabel    = "__cw_unit"
-	acceptHeader   = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3`
+	// CloudWatch accepts up to 30 dimensions per metric, with names of up to 255 and values of up to 1024 characters
+	cwMaxDimensions           = 30
+	cwMaxDimensionNameLength  = 255
+	cwMaxDimensionValueLength = 1024
+	// CloudWatch accepts timestamps up to two weeks in the past and up to two hours in the future
+	cwMaxTimestampAge    = 14 * 24 * time.Hour
+	cwMaxTimestampFuture = 2 * time.Hour
+	acceptHeader         = `application/openmetrics-text;version=1.0.0;q=0.8,application/openmetrics-text;version=0.0.1;q=0.75,application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3`
 )
 
 type StringSet map[string]bool
@@ -56,6 +72,74 @@ func getMatchingSet(matcherSets []MatcherWithStringSet, str string) StringSet {
 	return nil
 }
 
+// NamespaceRule publishes the metrics matching a Glob into a CloudWatch namespace
+type NamespaceRule struct {
+	Matcher   glob.Glob
+	Namespace string
+}
+
+// MatcherWithStringList defines a Glob matcher with an ordered list of associated strings
+type MatcherWithStringList struct {
+	Matcher glob.Glob
+	List    []string
+}
+
+// getMatchingList returns the first list that matches a string, or nil if there is no match
+func getMatchingList(matcherLists []MatcherWithStringList, str string) []string {
+	for _, matcherWithList := range matcherLists {
+		if matcherWithList.Matcher.Match(str) {
+			return matcherWithList.List
+		}
+	}
+	return nil
+}
+
+// AdditionalDimension defines a dimension added to every published metric.
+// The value is either static, or a template evaluated for each sample (see dimensionTemplateData)
+type AdditionalDimension struct {
+	Name string
+
+	// Template of the value. When nil, StaticValue is published as is
+	Value *template.Template
+
+	StaticValue string
+}
+
+// dimensionTemplateData is the data passed to the AdditionalDimension value templates
+type dimensionTemplateData struct {
+	// Labels of the sample being published
+	Labels map[string]string
+
+	// Hostname of the machine running the bridge
+	Hostname string
+}
+
+// DimensionTemplateFuncs are the functions available to the AdditionalDimension value templates
+var DimensionTemplateFuncs = template.FuncMap{
+	"env": os.Getenv,
+}
+
+// NewAdditionalDimension parses the value template and returns an AdditionalDimension,
+// or an error if the template is invalid
+func NewAdditionalDimension(name, value string) (AdditionalDimension, error) {
+	if name == "" {
+		return AdditionalDimension{}, errors.New("additional dimension name required")
+	}
+	tmpl, err := template.New(name).Funcs(DimensionTemplateFuncs).Option("missingkey=zero").Parse(value)
+	if err != nil {
+		return AdditionalDimension{}, err
+	}
+	return AdditionalDimension{Name: name, Value: tmpl}, nil
+}
+
+// NewStaticDimension returns an AdditionalDimension with a value published as is, without evaluating it as a template
+func NewStaticDimension(name, value string) (AdditionalDimension, error) {
+	if name == "" {
+		return AdditionalDimension{}, errors.New("additional dimension name required")
+	}
+	return AdditionalDimension{Name: name, StaticValue: value}, nil
+}
+
 // Config defines configuration options
 type Config struct {
 	// AWS access key Id with permissions to publish CloudWatch metrics
@@ -70,29 +154,144 @@ type Config struct {
 	// Required. The CloudWatch namespace under which metrics should be published
 	CloudWatchNamespace string
 
+	// Label whose value is used as the CloudWatch namespace of a sample, instead of NamespaceRules and CloudWatchNamespace.
+	// The label is not published as a dimension
+	NamespaceLabel string
+
+	// Publish metrics into the namespace of the first matching rule instead of CloudWatchNamespace (e.g. kafka_* into Kafka/Brokers)
+	NamespaceRules []NamespaceRule
+
 	// Required. The AWS Region to use
 	CloudWatchRegion string
 
+	// Additional regions and accounts receiving the same metrics, concurrently with CloudWatchRegion
+	Destinations []Destination
+
 	// The frequency with which metrics should be published to Cloudwatch. Default: 15s
 	CloudWatchPublishInterval time.Duration
 
+	// The frequency with which the scrape URL, queries and textfiles are collected. Samples collected between two
+	// publishes are aggregated per series and published as StatisticSets. Default: CloudWatchPublishInterval
+	PrometheusScrapeInterval time.Duration
+
+	// StatisticSets publishes every series as a StatisticSet (Minimum, Maximum, Sum and SampleCount) of its samples
+	// during the publish interval, including all the samples received by the remote-write and OTLP receivers,
+	// instead of their latest value
+	StatisticSets bool
+
+	// InferUnits sets the unit of metrics without a __cw_unit label from their name, following the Prometheus naming
+	// conventions (e.g. `_seconds` is Seconds, `_bytes` is Bytes, `_total` is Count, and `_ratio` is Percent scaled by 100)
+	InferUnits bool
+
+	// Set the unit of the metrics matching a pattern, regardless of their labels and names
+	UnitOverrides []UnitOverride
+
+	// Multiply the values of the metrics matching a pattern and set their unit (e.g. *_seconds in Milliseconds with a factor of 1000).
+	// Conversions take precedence over UnitOverrides, the __cw_unit label and InferUnits
+	UnitConversions []UnitConversion
+
+	// Rename the published metrics. The first rule whose regular expression matches the Prometheus name applies
+	RenameRules []RenameRule
+
+	// Prefixes and suffixes removed from the names of the metrics not renamed by RenameRules (e.g. ["node_"] and ["_total"])
+	StripPrefixes []string
+	StripSuffixes []string
+
+	// Convert the published metric names from snake_case to PascalCase (e.g. http_requests_total to HttpRequestsTotal)
+	PascalCaseNames bool
+
 	// Timeout for sending metrics to Cloudwatch. Default: 3s
 	CloudWatchPublishTimeout time.Duration
 
+	// Number of concurrent PutMetricData requests per destination. Default: 4
+	PublishConcurrency int
+
+	// Maximum PutMetricData requests per second per destination, to stay within the CloudWatch TPS quota. Default: no limit
+	PublishRateLimit float64
+
+	// Deadline of a scrape and publish cycle, after which remaining batches are dropped. Default: CloudWatchPublishInterval
+	PublishCycleTimeout time.Duration
+
 	// Prometheus scrape URL
 	PrometheusScrapeUrl string
 
+	// Series selectors to federate from the Prometheus server at PrometheusScrapeUrl (e.g. ['{job="node"}', 'up']).
+	// The /federate URL is built from PrometheusScrapeUrl and the federated timestamps are honored
+	FederationMatchers []string
+
+	// Remove the instance and job labels from federated series
+	FederationStripLabels bool
+
+	// Address of the HTTP server of the push receivers. Default: :9099
+	ListenAddress string
+
+	// Accept Prometheus remote-write requests on /api/v1/write
+	RemoteWriteReceiver bool
+
+	// Accept Pushgateway-compatible pushes on /metrics/job/<JOB>{/<LABEL>/<VALUE>}.
+	// Pushed metrics are published on every cycle until deleted
+	PushReceiver bool
+
+	// Delete pushed metrics once they have been published
+	PushDeleteAfterPublish bool
+
+	// Accept OTLP/HTTP metric exports (protobuf or JSON) on /v1/metrics
+	OTLPReceiver bool
+
+	// Resource attributes added as dimensions to the metrics received with OTLP, or ["*"] for all of them.
+	// Default: service.name, service.namespace and deployment.environment, as most other resource attributes identify
+	// short-lived processes or hosts and would multiply the number of CloudWatch metrics
+	OTLPResourceAttributes []string
+
+	// UDP address to receive StatsD and DogStatsD metrics on (e.g. :8125). Metrics are aggregated per publish interval
+	StatsdListenAddress string
+
+	// Directory to read *.prom files from on every cycle, like the node_exporter textfile collector
+	TextfileDirectory string
+
+	// Base URL of a Prometheus (or Thanos) server to run PrometheusQueries against.
+	// The scrape TLS client certificate, CA bundle and authentication are used for it when PrometheusScrapeUrl is not set,
+	// or has the same scheme and host
+	PrometheusQueryUrl string
+
+	// PromQL queries evaluated on every cycle. Their results are published under the query name
+	PrometheusQueries []PromQLQuery
+
 	// Path to Certificate file
 	PrometheusCertPath string
 
 	// Path to Key file
 	PrometheusKeyPath string
 
-	// Accept any certificate during TLS handshake. Insecure, use only for testing
+	// Accept any certificate during TLS handshake. Insecure, use only for testing. Can't be combined with PrometheusCAPath, PrometheusServerName or PrometheusMinTLSVersion
 	PrometheusSkipServerCertCheck bool
 
-	// Additional dimensions to send to CloudWatch
-	AdditionalDimensions map[string]string
+	// Path to a PEM encoded CA bundle used to verify the scrape server certificate. Default: system roots
+	PrometheusCAPath string
+
+	// Server name used to verify the scrape server certificate. Default: the host of PrometheusScrapeUrl
+	PrometheusServerName string
+
+	// Minimum TLS version accepted when scraping (e.g. tls.VersionTLS12). Default: TLS 1.0
+	PrometheusMinTLSVersion uint16
+
+	// Bearer token sent in the Authorization header of scrape requests
+	PrometheusBearerToken string
+
+	// Path to a file containing the bearer token. The file is re-read on every scrape to pick up rotated tokens
+	PrometheusBearerTokenFile string
+
+	// Username for basic authentication of scrape requests
+	PrometheusBasicAuthUsername string
+
+	// Password for basic authentication of scrape requests
+	PrometheusBasicAuthPassword string
+
+	// Additional headers sent with scrape requests
+	PrometheusHeaders map[string]string
+
+	// Additional dimensions to send to CloudWatch. Values are templates evaluated for each sample
+	AdditionalDimensions []AdditionalDimension
 
 	// Replace dimensions with the provided label. This allows for aggregating metrics across dimensions so we can set CloudWatch Alarms on the metrics
 	ReplaceDimensions map[string]string
@@ -109,26 +308,85 @@ type Config struct {
 	// Exclude certain dimensions from the specified metrics
 	ExcludeDimensionsForMetrics []MatcherWithStringSet
 
+	// Only publish the specified metrics when their value changes, or when PublishOnChangeHeartbeat expired
+	// since they were last published (a list of glob patterns, e.g. ["up", "*_info"])
+	PublishOnChange []glob.Glob
+
+	// Interval after which unchanged values of PublishOnChange metrics are published again. Default: 5m
+	PublishOnChangeHeartbeat time.Duration
+
+	// Maximum number of dimensions of a published metric, including AdditionalDimensions. Default and maximum: 30
+	MaxDimensions int
+
+	// The labels of the specified metrics kept first, in order, when a metric has more than MaxDimensions labels.
+	// Other labels are kept in alphabetical order
+	DimensionPriorities []MatcherWithStringList
+
 	// ForceHighRes forces all exported metrics to be sent as custom high-resolution metrics.
 	ForceHighRes bool
+
+	// HonorTimestamps publishes samples with the timestamps exposed by the scrape target instead of the scrape time.
+	// Samples outside the window accepted by CloudWatch are dropped, and a sample is not published again while its timestamp doesn't change
+	HonorTimestamps bool
+
+	// Drop samples whose exposed timestamp is older than this. Only used with HonorTimestamps. Default: the two weeks accepted by CloudWatch
+	MaxSampleAge time.Duration
 }
 
 // Bridge pushes metrics to AWS CloudWatch
 type Bridge struct {
-	cloudWatchPublishInterval     time.Duration
-	cloudWatchNamespace           string
-	cw                            *cloudwatch.CloudWatch
-	prometheusScrapeUrl           string
-	prometheusCertPath            string
-	prometheusKeyPath             string
-	prometheusSkipServerCertCheck bool
-	additionalDimensions          map[string]string
-	replaceDimensions             map[string]string
-	includeMetrics                []glob.Glob
-	excludeMetrics                []glob.Glob
-	includeDimensionsForMetrics   []MatcherWithStringSet
-	excludeDimensionsForMetrics   []MatcherWithStringSet
-	forceHighRes                  bool
+	cloudWatchPublishInterval   time.Duration
+	namespaceLabel              model.LabelName
+	namespaceRules              []NamespaceRule
+	destinations                []*destination
+	prometheusScrapeInterval    time.Duration
+	aggregated                  *sampleAggregator
+	statisticSets               bool
+	publishConcurrency          int
+	publishCycleTimeout         time.Duration
+	prometheusScrapeUrl         string
+	federationStripLabels       bool
+	prometheusQueryUrl          string
+	listenAddress               string
+	mux                         *http.ServeMux
+	received                    *sampleBuffer
+	pushed                      *pushStore
+	pushDeleteAfterPublish      bool
+	otlpResourceAttributes      StringSet
+	statsdListenAddress         string
+	textfileDirectory           string
+	statsd                      *statsdAggregator
+	prometheusQueries           []PromQLQuery
+	prometheusTLS               *scrapeTLS
+	prometheusAuth              *scrapeAuth
+	queryTLS                    *scrapeTLS
+	queryAuth                   *scrapeAuth
+	additionalDimensions        []AdditionalDimension
+	hostname                    string
+	replaceDimensions           map[string]string
+	includeMetrics              []glob.Glob
+	excludeMetrics              []glob.Glob
+	includeDimensionsForMetrics []MatcherWithStringSet
+	excludeDimensionsForMetrics []MatcherWithStringSet
+	publishOnChange             []glob.Glob
+	publishOnChangeHeartbeat    time.Duration
+	lastPublished               publishedSeries
+	maxDimensions               int
+	dimensionPriorities         []MatcherWithStringList
+	truncatedSeries             map[model.Fingerprint]bool
+	truncatedSeriesCycle        map[model.Fingerprint]bool
+	truncatedSeriesMtx          sync.Mutex
+	forceHighRes                bool
+	inferUnits                  bool
+	unitOverrides               []UnitOverride
+	unitConversions             []UnitConversion
+	renameRules                 []RenameRule
+	stripPrefixes               []string
+	stripSuffixes               []string
+	pascalCaseNames             bool
+	honorTimestamps             bool
+	maxSampleAge                time.Duration
+	publishedTimestamps         publishedSeries
 }
 
 // NewBridge initializes and returns a pointer to a Bridge using the
@@ -139,23 +397,161 @@ func NewBridge(c *Config) (*Bridge, error) {
 	if c.CloudWatchNamespace == "" {
 		return nil, errors.New("CloudWatchNamespace required")
 	}
-	b.cloudWatchNamespace = c.CloudWatchNamespace
+	// CloudWatch would reject every request into an invalid namespace
+	if err := validateNamespace(c.CloudWatchNamespace); err != nil {
+		return nil, fmt.Errorf("invalid CloudWatchNamespace %q: %s", c.CloudWatchNamespace, err)
+	}
+	for _, rule := range c.NamespaceRules {
+		if err := validateNamespace(rule.Namespace); err != nil {
+			return nil, fmt.Errorf("invalid namespace %q in NamespaceRules: %s", rule.Namespace, err)
+		}
+	}
+	for _, d := range c.Destinations {
+		if d.Namespace == "" {
+			continue
+		}
+		if err := validateNamespace(d.Namespace); err != nil {
+			return nil, fmt.Errorf("invalid namespace %q of destination %s: %s", d.Namespace, d.Region, err)
+		}
+	}
+	b.namespaceLabel = model.LabelName(c.NamespaceLabel)
+	b.namespaceRules = c.NamespaceRules
 
-	if c.PrometheusScrapeUrl == "" {
-		return nil, errors.New("PrometheusScrapeUrl required")
+	if c.PrometheusScrapeUrl == "" && len(c.PrometheusQueries) == 0 && !c.RemoteWriteReceiver && !c.PushReceiver && !c.OTLPReceiver && c.StatsdListenAddress == "" && c.TextfileDirectory == "" {
+		return nil, errors.New("PrometheusScrapeUrl, PrometheusQueries, RemoteWriteReceiver, PushReceiver, OTLPReceiver, StatsdListenAddress or TextfileDirectory required")
+	}
+	if runningInLambda() && (c.RemoteWriteReceiver || c.PushReceiver || c.OTLPReceiver || c.StatsdListenAddress != "") {
+		// Nothing runs between invocations to receive the metrics
+		return nil, errors.New("RemoteWriteReceiver, PushReceiver, OTLPReceiver and StatsdListenAddress are not available in Lambda")
+	}
+	if len(c.PrometheusQueries) > 0 && c.PrometheusQueryUrl == "" {
+		return nil, errors.New("PrometheusQueryUrl required when using PrometheusQueries")
 	}
 	b.prometheusScrapeUrl = c.PrometheusScrapeUrl
+	if len(c.FederationMatchers) > 0 {
+		if c.PrometheusScrapeUrl == "" {
+			return nil, errors.New("PrometheusScrapeUrl required when using FederationMatchers")
+		}
+		u, err := federateUrl(c.PrometheusScrapeUrl, c.FederationMatchers)
+		if err != nil {
+			return nil, err
+		}
+		b.prometheusScrapeUrl = u
+		b.federationStripLabels = c.FederationStripLabels
+	}
+	b.prometheusQueryUrl = c.PrometheusQueryUrl
+	b.prometheusQueries = c.PrometheusQueries
+	b.textfileDirectory = c.TextfileDirectory
 
-	b.prometheusCertPath = c.PrometheusCertPath
-	b.prometheusKeyPath = c.PrometheusKeyPath
-	b.prometheusSkipServerCertCheck = c.PrometheusSkipServerCertCheck
+	b.received = newSampleBuffer()
+	if c.RemoteWriteReceiver {
+		b.handle(remoteWritePath, b.handleRemoteWrite)
+	}
+	b.pushed = newPushStore()
+	b.pushDeleteAfterPublish = c.PushDeleteAfterPublish
+	if c.PushReceiver {
+		b.handle(pushPath, b.handlePush)
+	}
+	if c.OTLPReceiver {
+		switch {
+		case len(c.OTLPResourceAttributes) == 0:
+			b.otlpResourceAttributes = stringSliceToSet(defaultOTLPResourceAttributes)
+		case len(c.OTLPResourceAttributes) == 1 && c.OTLPResourceAttributes[0] == "*":
+			// All resource attributes
+		default:
+			b.otlpResourceAttributes = stringSliceToSet(c.OTLPResourceAttributes)
+		}
+		b.handle(otlpMetricsPath, b.handleOTLP)
+	}
+	b.statsdListenAddress = c.StatsdListenAddress
+	b.statsd = newStatsdAggregator()
+	if c.ListenAddress != "" {
+		b.listenAddress = c.ListenAddress
+	} else {
+		b.listenAddress = ":9099"
+	}
+
+	if (c.PrometheusCertPath != "") != (c.PrometheusKeyPath != "") {
+		return nil, errors.New("both or neither of PrometheusCertPath and PrometheusKeyPath must be configured")
+	}
+	if c.PrometheusSkipServerCertCheck && (c.PrometheusCAPath != "" || c.PrometheusServerName != "" || c.PrometheusMinTLSVersion != 0) {
+		return nil, errors.New("PrometheusSkipServerCertCheck can't be combined with PrometheusCAPath, PrometheusServerName or PrometheusMinTLSVersion")
+	}
+	b.prometheusTLS = &scrapeTLS{
+		certPath:           c.PrometheusCertPath,
+		keyPath:            c.PrometheusKeyPath,
+		caPath:             c.PrometheusCAPath,
+		serverName:         c.PrometheusServerName,
+		minVersion:         c.PrometheusMinTLSVersion,
+		insecureSkipVerify: c.PrometheusSkipServerCertCheck,
+	}
+
+	if c.PrometheusBearerToken != "" && c.PrometheusBearerTokenFile != "" {
+		return nil, errors.New("at most one of PrometheusBearerToken and PrometheusBearerTokenFile may be configured")
+	}
+	if (c.PrometheusBearerToken != "" || c.PrometheusBearerTokenFile != "") && c.PrometheusBasicAuthUsername != "" {
+		return nil, errors.New("at most one of bearer token and basic authentication may be configured")
+	}
+	b.prometheusAuth = &scrapeAuth{
+		bearerToken:       c.PrometheusBearerToken,
+		bearerTokenFile:   c.PrometheusBearerTokenFile,
+		basicAuthUsername: c.PrometheusBasicAuthUsername,
+		basicAuthPassword: c.PrometheusBasicAuthPassword,
+		headers:           c.PrometheusHeaders,
+	}
+	// Without a scrape URL, the settings are for the query URL. Otherwise the scrape credentials must not leak to a different server
+	if c.PrometheusScrapeUrl == "" || sameOrigin(c.PrometheusScrapeUrl, c.PrometheusQueryUrl) {
+		b.queryTLS, b.queryAuth = b.prometheusTLS, b.prometheusAuth
+	} else {
+		b.queryTLS = &scrapeTLS{minVersion: c.PrometheusMinTLSVersion}
+	}
 	b.additionalDimensions = c.AdditionalDimensions
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Println("prometheus-to-cloudwatch: error getting hostname:", err)
+	}
+	b.hostname = hostname
 	b.replaceDimensions = c.ReplaceDimensions
 	b.includeMetrics = c.IncludeMetrics
 	b.excludeMetrics = c.ExcludeMetrics
 	b.includeDimensionsForMetrics = c.IncludeDimensionsForMetrics
 	b.excludeDimensionsForMetrics = c.ExcludeDimensionsForMetrics
+	b.publishOnChange = c.PublishOnChange
+	if c.PublishOnChangeHeartbeat > 0 {
+		b.publishOnChangeHeartbeat = c.PublishOnChangeHeartbeat
+	} else {
+		b.publishOnChangeHeartbeat = 5 * time.Minute
+	}
+
+	if c.MaxDimensions > cwMaxDimensions {
+		return nil, fmt.Errorf("MaxDimensions must not exceed %d", cwMaxDimensions)
+	} else if c.MaxDimensions > 0 {
+		b.maxDimensions = c.MaxDimensions
+	} else {
+		b.maxDimensions = cwMaxDimensions
+	}
+	if len(c.AdditionalDimensions) > b.maxDimensions {
+		return nil, errors.New("more AdditionalDimensions than MaxDimensions")
+	}
+	b.dimensionPriorities = c.DimensionPriorities
+	b.truncatedSeries = make(map[model.Fingerprint]bool)
+	b.truncatedSeriesCycle = make(map[model.Fingerprint]bool)
 	b.forceHighRes = c.ForceHighRes
+	b.inferUnits = c.InferUnits
+	b.unitOverrides = c.UnitOverrides
+	b.unitConversions = c.UnitConversions
+	b.renameRules = c.RenameRules
+	b.stripPrefixes = c.StripPrefixes
+	b.stripSuffixes = c.StripSuffixes
+	b.pascalCaseNames = c.PascalCaseNames
+	// Federated samples carry the timestamps of the federated server
+	b.honorTimestamps = c.HonorTimestamps || len(c.FederationMatchers) > 0
+
+	if c.MaxSampleAge > 0 && c.MaxSampleAge < cwMaxTimestampAge {
+		b.maxSampleAge = c.MaxSampleAge
+	} else {
+		b.maxSampleAge = cwMaxTimestampAge
+	}
 
 	if c.CloudWatchPublishInterval > 0 {
 		b.cloudWatchPublishInterval = c.CloudWatchPublishInterval
@@ -163,6 +559,28 @@ func NewBridge(c *Config) (*Bridge, error) {
 		b.cloudWatchPublishInterval = 30 * time.Second
 	}
 
+	if c.PrometheusScrapeInterval > b.cloudWatchPublishInterval {
+		return nil, errors.New("PrometheusScrapeInterval must not exceed CloudWatchPublishInterval")
+	} else if c.PrometheusScrapeInterval > 0 {
+		b.prometheusScrapeInterval = c.PrometheusScrapeInterval
+	} else {
+		b.prometheusScrapeInterval = b.cloudWatchPublishInterval
+	}
+	b.aggregated = newSampleAggregator()
+	b.statisticSets = c.StatisticSets
+
+	if c.PublishConcurrency > 0 {
+		b.publishConcurrency = c.PublishConcurrency
+	} else {
+		b.publishConcurrency = 4
+	}
+
+	if c.PublishCycleTimeout > 0 {
+		b.publishCycleTimeout = c.PublishCycleTimeout
+	} else {
+		b.publishCycleTimeout = b.cloudWatchPublishInterval
+	}
+
 	var client = http.DefaultClient
 
 	if c.CloudWatchPublishTimeout > 0 {
@@ -191,7 +609,18 @@ func NewBridge(c *Config) (*Bridge, error) {
 		return nil, err
 	}
 
-	b.cw = cloudwatch.New(sess)
+	primary, err := newDestination(sess, Destination{Region: c.CloudWatchRegion}, c.CloudWatchNamespace, c.PublishRateLimit)
+	if err != nil {
+		return nil, err
+	}
+	b.destinations = append(b.destinations, primary)
+	for _, d := range c.Destinations {
+		dest, err := newDestination(sess, d, c.CloudWatchNamespace, c.PublishRateLimit)
+		if err != nil {
+			return nil, err
+		}
+		b.destinations = append(b.destinations, dest)
+	}
 	return b, nil
 }
 
@@ -200,20 +629,34 @@ func (b *Bridge) Run(ctx context.Context) {
 	ticker := time.NewTicker(b.cloudWatchPublishInterval)
 	defer ticker.Stop()
 
+	if b.mux != nil {
+		go b.serve(ctx)
+	}
+	if b.statsdListenAddress != "" {
+		go b.listenStatsd(ctx)
+	}
+
+	// Scrapes happen on their own schedule when more frequent than publishes, and are aggregated until the next publish
+	separateScrapes := b.prometheusScrapeInterval < b.cloudWatchPublishInterval
+	if separateScrapes {
+		go b.scrapeEvery(ctx, b.prometheusScrapeInterval)
+	}
+
 	for {
 		select {
 		case <-ticker.C:
-			mfChan := make(chan *dto.MetricFamily, 1024)
-
-			go fetchMetricFamilies(b.prometheusScrapeUrl, mfChan, b.prometheusCertPath, b.prometheusKeyPath, b.prometheusSkipServerCertCheck)
-
-			var metricFamilies []*dto.MetricFamily
-			for mf := range mfChan {
-				metricFamilies = append(metricFamilies, mf)
+			var count int
+			var err error
+			if separateScrapes {
+				count, err = b.publishOnly(ctx)
+			} else {
+				count, err = b.PublishOnce(ctx)
 			}
-
-			count, err := b.publishMetricsToCloudWatch(metricFamilies)
-			if err != nil {
+			// The other sources are published when the scrape fails
+			var scrapeErr *ScrapeError
+			if errors.As(err, &scrapeErr) {
+				log.Println("prometheus-to-cloudwatch:", scrapeErr)
+			} else if err != nil {
 				log.Println("prometheus-to-cloudwatch: error publishing to CloudWatch:", err)
 			}
 
@@ -226,50 +669,293 @@ func (b *Bridge) Run(ctx context.Context) {
 	}
 }
 
-// NOTE: The CloudWatch API has the following limitations:
-//  - Max 40kb request size
-//	- Single namespace per request
-//	- Max 10 dimensions per metric
-func (b *Bridge) publishMetricsToCloudWatch(mfs []*dto.MetricFamily) (count int, e error) {
-	vec, err := expfmt.ExtractSamples(&expfmt.DecodeOptions{Timestamp: model.Now()}, mfs...)
+// PublishOnce performs a single cycle: it collects the samples from all configured sources
+// (scrape, queries, textfiles and the metrics received since the previous cycle) and publishes them to CloudWatch.
+// It returns the number of published metrics. When the scrape fails, the samples of the other sources are still published
+// and the scrape error is returned as a *ScrapeError
+func (b *Bridge) PublishOnce(ctx context.Context) (int, error) {
+	// A cycle must not overlap the next one
+	ctx, cancel := context.WithTimeout(ctx, b.publishCycleTimeout)
+	defer cancel()
+
+	now := model.Now()
+	scrapeErr := b.scrape(ctx, now)
+	count, err := b.publishCollected(ctx, now)
+	if err != nil {
+		return count, err
+	}
+	if scrapeErr != nil {
+		return count, &ScrapeError{Err: scrapeErr}
+	}
+	return count, nil
+}
+
+// ScrapeError is returned by PublishOnce when the scrape failed, after the metrics of the other sources were published
+type ScrapeError struct {
+	Err error
+}
+
+func (e *ScrapeError) Error() string {
+	return e.Err.Error()
+}
+
+// scrapeEvery scrapes at the interval until the context is done
+func (b *Bridge) scrapeEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			scrapeCtx, cancel := context.WithTimeout(ctx, interval)
+			if err := b.scrape(scrapeCtx, model.Now()); err != nil {
+				log.Println("prometheus-to-cloudwatch:", err)
+			}
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// publishOnly publishes what was collected since the previous cycle, without scraping
+func (b *Bridge) publishOnly(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.publishCycleTimeout)
+	defer cancel()
+
+	return b.publishCollected(ctx, model.Now())
+}
+
+// scrape collects the samples of the polled sources (scrape, queries and textfiles) into the aggregator.
+// A failed scrape is skipped, the next one may succeed (e.g. once a rotated token file is written), and its error
+// is returned after the samples of the other sources are collected
+func (b *Bridge) scrape(ctx context.Context, now model.Time) error {
+	var vec model.Vector
+	var scrapeErr error
+	exposed := make(timestampedSeries)
+
+	if b.prometheusScrapeUrl != "" {
+		metricFamilies, err := fetchMetricFamilies(ctx, b.prometheusScrapeUrl, b.prometheusTLS, b.prometheusAuth)
+		if err != nil {
+			scrapeErr = fmt.Errorf("scraping Prometheus failed: %s", err)
+		}
+
+		samples, err := extractSamples(metricFamilies)
+		if err != nil {
+			log.Println("prometheus-to-cloudwatch: error decoding scraped metrics:", err)
+		}
+		if b.federationStripLabels {
+			stripFederationLabels(samples)
+		}
+		stampSamples(samples, now, exposed)
+		vec = append(vec, samples...)
+	}
+
+	if len(b.prometheusQueries) > 0 {
+		vec = append(vec, b.queryPrometheus(ctx, now)...)
+	}
 
+	if b.textfileDirectory != "" {
+		vec = append(vec, b.readTextfiles(now, exposed)...)
+	}
+
+	b.aggregated.add(vec, exposed)
+	return scrapeErr
+}
+
+// publishCollected publishes the samples scraped since the previous cycle, aggregated per series,
+// together with the metrics received since then
+func (b *Bridge) publishCollected(ctx context.Context, now model.Time) (int, error) {
+	vec, stats, exposed := b.aggregated.drain()
+
+	for _, s := range b.received.drain() {
+		exposed[s.Metric.Fingerprint()] = true
+		vec = append(vec, s)
+	}
+
+	pushed, pushGroups, err := b.pushed.collect(now, b.pushDeleteAfterPublish, exposed)
 	if err != nil {
-		return 0, err
+		log.Println("prometheus-to-cloudwatch: error decoding pushed metrics:", err)
+	}
+	if !b.pushDeleteAfterPublish {
+		pushGroups = nil
 	}
+	vec = append(vec, pushed...)
+	vec = append(vec, b.statsd.flush(now)...)
 
-	data := make([]*cloudwatch.MetricDatum, 0, batchSize)
+	return b.publishMetricsToCloudWatch(ctx, vec, stats, exposed, pushGroups, now)
+}
+
+// timestampedSeries is the set of series whose sample carries the timestamp exposed by its source,
+// as opposed to the time it was scraped or published at
+type timestampedSeries map[model.Fingerprint]bool
+
+// extractSamples converts the MetricFamilies into samples. Samples without an exposed timestamp are left unstamped
+// (model.Earliest) until stampSamples, so that the sources can relabel them first
+func extractSamples(mfs []*dto.MetricFamily) (model.Vector, error) {
+	return expfmt.ExtractSamples(&expfmt.DecodeOptions{Timestamp: model.Earliest}, mfs...)
+}
+
+// stampSamples stamps the unstamped samples with `now`, and adds the series of the others to `exposed`
+func stampSamples(vec model.Vector, now model.Time, exposed timestampedSeries) {
+	for _, s := range vec {
+		if s.Timestamp == model.Earliest {
+			s.Timestamp = now
+		} else if exposed != nil {
+			exposed[s.Metric.Fingerprint()] = true
+		}
+	}
+}
+
+// publishMetricsToCloudWatch publishes the samples. The pushed groups of `pushGroups` (the group of each pushed series)
+// are deleted once all their series are published to every destination.
+//
+// NOTE: The CloudWatch API has the following limitations:
+//   - Max 40kb request size
+//   - Single namespace per request
+//   - Max 30 dimensions per metric
+func (b *Bridge) publishMetricsToCloudWatch(ctx context.Context, vec model.Vector, stats map[model.Fingerprint]*statistics, exposed timestampedSeries, pushGroups map[model.Fingerprint]pushGeneration, now model.Time) (count int, e error) {
+	// Metrics are batched per namespace, as a request can only publish into one
+	pending := make(map[string]*namespaceBatch)
+	var batches []*namespaceBatch
+	// Series of the cycle published with their exposed timestamp, and in publish on change mode
+	seenTimestamps := make(map[model.Fingerprint]publishedValue)
+	seen := make(map[model.Fingerprint]publishedValue)
 
 	for _, s := range vec {
 		name := getName(s.Metric)
 		if b.shouldIgnoreMetric(name) {
 			continue
 		}
-		data = appendDatum(data, name, s, b)
-
-		if len(data) == batchSize {
-			count += batchSize
-			if err := b.flush(data); err != nil {
-				log.Println("prometheus-to-cloudwatch: error publishing to CloudWatch:", err)
+		exposedTimestamp := b.honorTimestamps && exposed[s.Metric.Fingerprint()]
+		if !exposedTimestamp {
+			s.Timestamp = now
+		} else if !b.acceptTimestamp(s, now, seenTimestamps) {
+			continue
+		}
+		var st *statistics
+		if stats != nil {
+			st = stats[s.Metric.Fingerprint()]
+		}
+		namespace := b.getNamespace(s.Metric, name)
+		batch := pending[namespace]
+		if batch == nil {
+			batch = newNamespaceBatch(namespace)
+			pending[namespace] = batch
+		}
+		if b.skipUnchanged(s, name, st, now, seen) {
+			continue
+		}
+		appended := len(batch.data)
+		batch.data = appendDatum(batch.data, name, s, st, b)
+		// Samples dropped as invalid are not recorded as published
+		if len(batch.data) > appended {
+			b.recordChanged(s, name, now, batch.changed)
+			if exposedTimestamp {
+				batch.timestamps[s.Metric.Fingerprint()] = publishedValue{value: s.Value, at: s.Timestamp}
 			}
-			data = make([]*cloudwatch.MetricDatum, 0, batchSize)
+		}
+		if g, ok := pushGroups[s.Metric.Fingerprint()]; ok {
+			batch.pushGroups[g] = true
+		}
+
+		if len(batch.data) >= batchSize {
+			batches = append(batches, batch)
+			delete(pending, namespace)
+		}
+	}
+
+	if b.honorTimestamps {
+		b.publishedTimestamps.keep(seenTimestamps)
+	}
+	if len(b.publishOnChange) > 0 {
+		b.lastPublished.keep(seen)
+	}
+
+	b.rotateTruncatedSeries()
+
+	for _, batch := range pending {
+		if len(batch.data) > 0 {
+			batches = append(batches, batch)
+		}
+	}
+	for _, batch := range batches {
+		count += len(batch.data)
+	}
+	err := b.publish(ctx, batches)
+
+	// What didn't reach every destination is published again on the next cycle
+	unpublishedGroups := make(map[pushGeneration]bool)
+	for _, batch := range batches {
+		if batch.published {
+			b.lastPublished.record(batch.changed)
+			b.publishedTimestamps.record(batch.timestamps)
+			continue
+		}
+		for g := range batch.pushGroups {
+			unpublishedGroups[g] = true
+		}
+	}
+	publishedGroups := make(map[pushGeneration]bool)
+	for _, g := range pushGroups {
+		if !unpublishedGroups[g] {
+			publishedGroups[g] = true
 		}
 	}
+	b.pushed.deleteCollected(publishedGroups)
 
-	count += len(data)
-	return count, b.flush(data)
+	return count, err
 }
 
-func (b *Bridge) flush(data []*cloudwatch.MetricDatum) error {
-	if len(data) > 0 {
-		in := &cloudwatch.PutMetricDataInput{
-			MetricData: data,
-			Namespace:  &b.cloudWatchNamespace,
+// getNamespace returns the namespace to publish the metric into: the value of the namespace label if set,
+// otherwise the namespace of the first matching rule, otherwise "" for the default namespace of the destination.
+// Invalid namespace label values are logged and replaced with the default namespace, as CloudWatch would reject the
+// whole request
+func (b *Bridge) getNamespace(m model.Metric, name string) string {
+	if b.namespaceLabel != "" {
+		if namespace := m[b.namespaceLabel]; namespace != "" {
+			if err := validateNamespace(string(namespace)); err != nil {
+				log.Printf("prometheus-to-cloudwatch: publishing %s into the default namespace: invalid namespace %q: %s", name, namespace, err)
+				return ""
+			}
+			return string(namespace)
 		}
-		req, _ := b.cw.PutMetricDataRequest(in)
-		req.Handlers.Build.PushBack(compressPayload)
-		return req.Send()
 	}
-	return nil
+	for _, rule := range b.namespaceRules {
+		if rule.Matcher.Match(name) {
+			return rule.Namespace
+		}
+	}
+	return ""
+}
+
+// acceptTimestamp reports whether a sample with an exposed timestamp should be published.
+// Samples older than the max sample age or outside the window accepted by CloudWatch are dropped,
+// as are samples whose timestamp was already published for the series in a previous cycle (e.g. unchanged federated or pushed series).
+// The timestamps last published for the series of the cycle are carried over in `seen`, the accepted timestamps are
+// recorded once their batch is sent
+func (b *Bridge) acceptTimestamp(s *model.Sample, now model.Time, seen map[model.Fingerprint]publishedValue) bool {
+	if s.Timestamp.Before(now.Add(-b.maxSampleAge)) || s.Timestamp.After(now.Add(cwMaxTimestampFuture)) {
+		return false
+	}
+
+	last, ok := b.publishedTimestamps.get(s.Metric.Fingerprint(), seen)
+	return !ok || s.Timestamp.After(last.at)
+}
+
+// put sends a PutMetricData request with the datums
+func (d *destination) put(ctx context.Context, namespace string, data []*cloudwatch.MetricDatum) error {
+	if err := d.limiter.wait(ctx); err != nil {
+		return err
+	}
+	in := &cloudwatch.PutMetricDataInput{
+		MetricData: data,
+		Namespace:  aws.String(namespace),
+	}
+	req, _ := d.cw.PutMetricDataRequest(in)
+	req.SetContext(ctx)
+	req.Handlers.Build.PushBack(compressPayload)
+	return req.Send()
 }
 
 // Compresses the payload before sending it to the API.
@@ -312,7 +998,7 @@ func anyPatternMatches(patterns []glob.Glob, s string) bool {
 	return false
 }
 
-func appendDatum(data []*cloudwatch.MetricDatum, name string, s *model.Sample, b *Bridge) []*cloudwatch.MetricDatum {
+func appendDatum(data []*cloudwatch.MetricDatum, name string, s *model.Sample, st *statistics, b *Bridge) []*cloudwatch.MetricDatum {
 	metric := s.Metric
 
 	if len(metric) == 0 {
@@ -325,32 +1011,62 @@ func appendDatum(data []*cloudwatch.MetricDatum, name string, s *model.Sample, b
 		return data
 	}
 
+	unit, scale := b.getUnit(metric, name)
+	if scale != 1 {
+		value *= scale
+		st = st.scale(scale)
+		// The converted value may be out of the range accepted by CloudWatch
+		if !validValue(value) {
+			return data
+		}
+	}
+
 	datum := &cloudwatch.MetricDatum{}
+	metricName := b.getMetricName(name, metric)
 
-	kubeStateDimensions, replacedDimensions := getDimensions(metric, 10-len(b.additionalDimensions), b)
-	datum.SetMetricName(name).
-		SetValue(value).
+	additionalDimensions := getAdditionalDimensions(metric, b)
+	kubeStateDimensions, replacedDimensions := getDimensions(metric, b.maxDimensions-len(additionalDimensions), b)
+	datum.SetMetricName(metricName).
 		SetTimestamp(s.Timestamp.Time()).
-		SetDimensions(append(kubeStateDimensions, getAdditionalDimensions(b)...)).
+		SetDimensions(append(kubeStateDimensions, additionalDimensions...)).
 		SetStorageResolution(b.getResolution(metric)).
-		SetUnit(getUnit(metric))
-	data = append(data, datum)
+		SetUnit(unit)
+	setDatumValue(datum, value, st, b.statisticSets)
+	data = appendValidDatum(data, datum)
 
 	// Don't add replacement if not configured
 	if replacedDimensions != nil && len(replacedDimensions) > 0 {
 		replacedDimensionDatum := &cloudwatch.MetricDatum{}
-		replacedDimensionDatum.SetMetricName(name).
-			SetValue(value).
+		replacedDimensionDatum.SetMetricName(metricName).
 			SetTimestamp(s.Timestamp.Time()).
-			SetDimensions(append(replacedDimensions, getAdditionalDimensions(b)...)).
+			SetDimensions(append(replacedDimensions, additionalDimensions...)).
 			SetStorageResolution(b.getResolution(metric)).
-			SetUnit(getUnit(metric))
-		data = append(data, replacedDimensionDatum)
+			SetUnit(unit)
+		setDatumValue(replacedDimensionDatum, value, st, b.statisticSets)
+		data = appendValidDatum(data, replacedDimensionDatum)
 	}
 
 	return data
 }
 
+// setDatumValue sets the value of the datum, or a StatisticSet when several samples of the series were aggregated
+// or when `statisticSets` is enabled
+func setDatumValue(datum *cloudwatch.MetricDatum, value float64, st *statistics, statisticSets bool) {
+	if st == nil && statisticSets {
+		st = &statistics{min: value, max: value, sum: value, count: 1}
+	}
+	if st == nil || (st.count < 2 && !statisticSets) {
+		datum.SetValue(value)
+		return
+	}
+	datum.SetStatisticValues(&cloudwatch.StatisticSet{
+		Minimum:     aws.Float64(st.min),
+		Maximum:     aws.Float64(st.max),
+		Sum:         aws.Float64(st.sum),
+		SampleCount: aws.Float64(st.count),
+	})
+}
+
 var (
 	valueTooSmall = math.Pow(2, -260)
 	valueTooLarge = math.Pow(2, 260)
@@ -387,6 +1103,74 @@ func getName(m model.Metric) string {
 	return ""
 }
 
+var (
+	invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	invalidLabelNameChars  = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// sanitizeMetricName converts a name from another metrics system (e.g. `http.server.duration`) into a valid
+// Prometheus metric name (e.g. `http_server_duration`)
+func sanitizeMetricName(name string) string {
+	name = invalidMetricNameChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// newDimension returns a dimension with the name and value sanitized to be accepted by CloudWatch,
+// or nil if the value is empty, as a single invalid dimension makes CloudWatch reject the whole request
+func newDimension(name, value string) *cloudwatch.Dimension {
+	name = sanitizeDimensionString(name, cwMaxDimensionNameLength)
+	value = sanitizeDimensionString(value, cwMaxDimensionValueLength)
+	if name == "" || value == "" {
+		return nil
+	}
+	// Dimension names can't start with a colon
+	if name[0] == ':' {
+		name = "_" + name[1:]
+	}
+	return new(cloudwatch.Dimension).SetName(name).SetValue(value)
+}
+
+// sanitizeDimensionString replaces the characters CloudWatch doesn't accept in dimensions (non-ASCII and control
+// characters) with underscores, and truncates strings longer than `max` characters. Replaced or truncated strings get
+// a hash of the original string as suffix, so that they stay distinct (e.g. `café` and `cafë`).
+// Strings of only whitespace are returned as ""
+func sanitizeDimensionString(s string, max int) string {
+	if strings.TrimSpace(s) == "" {
+		return ""
+	}
+	replaced := false
+	sanitized := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || unicode.IsControl(r) {
+			replaced = true
+			return '_'
+		}
+		return r
+	}, s)
+	if !replaced && len(sanitized) <= max {
+		return sanitized
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	suffix := fmt.Sprintf("_%08x", h.Sum32())
+	if len(sanitized) > max-len(suffix) {
+		sanitized = sanitized[:max-len(suffix)]
+	}
+	return sanitized + suffix
+}
+
+// sanitizeLabelName converts an attribute or tag key (e.g. `service.name`) into a valid label name (e.g. `service_name`)
+func sanitizeLabelName(key string) model.LabelName {
+	name := invalidLabelNameChars.ReplaceAllString(key, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return model.LabelName(name)
+}
+
 // shouldIncludeDimension determines whether or not to keep this dimension when publishing to cloudwatch
 // if an `includeSet` is specified, this will only return `true` for dimensions in that set
 func shouldIncludeDimension(dimName model.LabelName, includeSet, excludeSet StringSet) bool {
@@ -408,8 +1192,9 @@ func shouldIncludeDimension(dimName model.LabelName, includeSet, excludeSet Stri
 	return includeSet[dimNameStr]
 }
 
-// getDimensions returns up to 10 dimensions for the provided metric - one for each label (except the __name__ label)
-// If a metric has more than 10 labels, it attempts to behave deterministically and returning the first 10 labels as dimensions
+// getDimensions returns up to `num` dimensions for the provided metric - one for each label (except the __name__ label)
+// If a metric has more labels, it attempts to behave deterministically and returns the labels with the highest priority
+// for the metric, then the first labels in alphabetical order, and logs a warning naming the dropped labels
 func getDimensions(m model.Metric, num int, b *Bridge) ([]*cloudwatch.Dimension, []*cloudwatch.Dimension) {
 	if len(m) == 0 {
 		return make([]*cloudwatch.Dimension, 0), nil
@@ -423,48 +1208,130 @@ func getDimensions(m model.Metric, num int, b *Bridge) ([]*cloudwatch.Dimension,
 	includeSet := getMatchingSet(b.includeDimensionsForMetrics, metricName)
 	excludeSet := getMatchingSet(b.excludeDimensionsForMetrics, metricName)
 
-	for dimName := range m {
-		if shouldIncludeDimension(dimName, includeSet, excludeSet) {
+	for dimName, val := range m {
+		// The namespace label selects the namespace, it isn't a dimension
+		if dimName != "" && val != "" && dimName != b.namespaceLabel && shouldIncludeDimension(dimName, includeSet, excludeSet) {
 			names = append(names, string(dimName))
 		}
 	}
 
-	sort.Strings(names)
+	sortDimensionNames(names, getMatchingList(b.dimensionPriorities, metricName))
+	if num < 0 {
+		num = 0
+	}
+
 	dims := make([]*cloudwatch.Dimension, 0, len(names))
 	replacedDims := make([]*cloudwatch.Dimension, 0, len(names))
+	var dropped []string
 
 	for _, name := range names {
-		if name != "" {
-			val := string(m[model.LabelName(name)])
-			if val != "" {
-				dims = append(dims, new(cloudwatch.Dimension).SetName(name).SetValue(val))
-				// Don't add replacement if not configured
-				if b.replaceDimensions != nil && len(b.replaceDimensions) > 0 {
-					if replacement, ok := b.replaceDimensions[name]; ok {
-						replacedDims = append(replacedDims, new(cloudwatch.Dimension).SetName(name).SetValue(replacement))
-					} else {
-						replacedDims = append(replacedDims, new(cloudwatch.Dimension).SetName(name).SetValue(val))
-					}
+		val := string(m[model.LabelName(name)])
+		dim := newDimension(name, val)
+		if dim == nil {
+			continue
+		}
+		if len(dims) == num {
+			dropped = append(dropped, name)
+			continue
+		}
+		dims = append(dims, dim)
+		// Don't add replacement if not configured
+		if b.replaceDimensions != nil && len(b.replaceDimensions) > 0 {
+			if replacement, ok := b.replaceDimensions[name]; ok {
+				if replacedDim := newDimension(name, replacement); replacedDim != nil {
+					replacedDims = append(replacedDims, replacedDim)
 				}
+			} else {
+				replacedDims = append(replacedDims, dim)
 			}
 		}
 	}
 
-	if len(dims) > num {
-		dims = dims[:num]
+	if len(dropped) > 0 {
+		b.warnTruncatedDimensions(m, dropped)
 	}
+	return dims, replacedDims
+}
 
-	if len(replacedDims) > num {
-		replacedDims = replacedDims[:num]
+// sortDimensionNames sorts the names in the order of the priorities, followed by the other names in alphabetical order
+func sortDimensionNames(names, priorities []string) {
+	rank := make(map[string]int, len(priorities))
+	for i, name := range priorities {
+		if _, ok := rank[name]; !ok {
+			rank[name] = i
+		}
 	}
+	sort.Slice(names, func(i, j int) bool {
+		ri, iok := rank[names[i]]
+		rj, jok := rank[names[j]]
+		switch {
+		case iok && jok:
+			return ri < rj
+		case iok != jok:
+			return iok
+		}
+		return names[i] < names[j]
+	})
+}
 
-	return dims, replacedDims
+// warnTruncatedDimensions logs the labels of a series dropped because of the dimension limit, once per series.
+// The series of the cycle are recorded in truncatedSeriesCycle, and replace those of the previous cycle
+// at the end of the cycle (see rotateTruncatedSeries)
+func (b *Bridge) warnTruncatedDimensions(m model.Metric, dropped []string) {
+	fp := m.Fingerprint()
+
+	b.truncatedSeriesMtx.Lock()
+	defer b.truncatedSeriesMtx.Unlock()
+
+	warned := b.truncatedSeries[fp] || b.truncatedSeriesCycle[fp]
+	b.truncatedSeriesCycle[fp] = true
+	if warned {
+		return
+	}
+	log.Printf("prometheus-to-cloudwatch: warning: %s exceeds the limit of %d dimensions, dropping labels %s", m, b.maxDimensions, strings.Join(dropped, ", "))
 }
 
-func getAdditionalDimensions(b *Bridge) []*cloudwatch.Dimension {
+// rotateTruncatedSeries only remembers the truncated series of the cycle, so that series which disappeared don't accumulate
+func (b *Bridge) rotateTruncatedSeries() {
+	b.truncatedSeriesMtx.Lock()
+	defer b.truncatedSeriesMtx.Unlock()
+
+	b.truncatedSeries = b.truncatedSeriesCycle
+	b.truncatedSeriesCycle = make(map[model.Fingerprint]bool)
+}
+
+// getAdditionalDimensions evaluates the additional dimension templates against the provided metric.
+// Dimensions whose template fails or renders an empty value are skipped, as CloudWatch rejects empty values
+func getAdditionalDimensions(m model.Metric, b *Bridge) []*cloudwatch.Dimension {
+	if len(b.additionalDimensions) == 0 {
+		return nil
+	}
+
+	data := dimensionTemplateData{
+		Labels:   make(map[string]string, len(m)),
+		Hostname: b.hostname,
+	}
+	for k, v := range m {
+		data.Labels[string(k)] = string(v)
+	}
+
 	dims := make([]*cloudwatch.Dimension, 0, len(b.additionalDimensions))
-	for k, v := range b.additionalDimensions {
-		dims = append(dims, new(cloudwatch.Dimension).SetName(k).SetValue(v))
+	var sb strings.Builder
+	for _, d := range b.additionalDimensions {
+		if d.Value == nil {
+			if dim := newDimension(d.Name, d.StaticValue); dim != nil {
+				dims = append(dims, dim)
+			}
+			continue
+		}
+		sb.Reset()
+		if err := d.Value.Execute(&sb, data); err != nil {
+			log.Printf("prometheus-to-cloudwatch: error evaluating additional dimension %q: %s", d.Name, err)
+			continue
+		}
+		if dim := newDimension(d.Name, sb.String()); dim != nil {
+			dims = append(dims, dim)
+		}
 	}
 	return dims
 }
@@ -480,84 +1347,179 @@ func (b *Bridge) getResolution(m model.Metric) int64 {
 	return 60
 }
 
-func getUnit(m model.Metric) string {
-	if u, ok := m[cwUnitLabel]; ok {
-		return string(u)
+// fetchMetricFamilies retrieves metrics from the provided URL and decodes them into MetricFamily proto messages.
+// The scrape is cancelled when the context is done, so that it doesn't outlast the cycle
+func fetchMetricFamilies(
+	ctx context.Context,
+	url string,
+	tlsSettings *scrapeTLS,
+	auth *scrapeAuth,
+) ([]*dto.MetricFamily, error) {
+	// The CA bundle or key pair may be missing or half-written while being rotated
+	tlsConfig, err := tlsSettings.config()
+	if err != nil {
+		return nil, err
 	}
-	return "None"
+	transport := &http.Transport{TLSClientConfig: tlsConfig}
+	client := &http.Client{Transport: transport}
+	defer client.CloseIdleConnections()
+	return decodeContent(ctx, client, url, auth)
 }
 
-// fetchMetricFamilies retrieves metrics from the provided URL, decodes them into MetricFamily proto messages, and sends them to the provided channel.
-// It returns after all MetricFamilies have been sent
-func fetchMetricFamilies(
-	url string, ch chan<- *dto.MetricFamily,
-	certificate string, key string,
-	skipServerCertCheck bool,
-) {
-	defer close(ch)
-	var transport *http.Transport
-	if certificate != "" && key != "" {
-		cert, err := tls.LoadX509KeyPair(certificate, key)
+// scrapeTLS holds the TLS settings used when scraping over HTTPS
+type scrapeTLS struct {
+	certPath           string
+	keyPath            string
+	caPath             string
+	serverName         string
+	minVersion         uint16
+	insecureSkipVerify bool
+}
+
+// config builds the tls.Config for a scrape. The CA bundle is read on every call and the client certificate
+// on every handshake, so rotated files are picked up without restarting the bridge
+func (t *scrapeTLS) config() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         t.serverName,
+		MinVersion:         t.minVersion,
+		InsecureSkipVerify: t.insecureSkipVerify,
+	}
+
+	if t.caPath != "" {
+		pem, err := ioutil.ReadFile(t.caPath)
 		if err != nil {
-			log.Fatal("prometheus-to-cloudwatch: Error: ", err)
+			return nil, fmt.Errorf("reading CA bundle %q failed: %s", t.caPath, err)
 		}
-		tlsConfig := &tls.Config{
-			Certificates:       []tls.Certificate{cert},
-			InsecureSkipVerify: skipServerCertCheck,
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %q", t.caPath)
 		}
-		tlsConfig.BuildNameToCertificate()
-		transport = &http.Transport{TLSClientConfig: tlsConfig}
-	} else {
-		transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: skipServerCertCheck},
+		tlsConfig.RootCAs = pool
+	}
+
+	if t.certPath != "" && t.keyPath != "" {
+		// Fail early on an invalid key pair rather than on the handshake
+		if _, err := tls.LoadX509KeyPair(t.certPath, t.keyPath); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(t.certPath, t.keyPath)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
 		}
 	}
-	client := &http.Client{Transport: transport}
-	decodeContent(client, url, ch)
-	client.CloseIdleConnections()
+
+	return tlsConfig, nil
+}
+
+// scrapeAuth holds the credentials and additional headers sent with scrape requests
+type scrapeAuth struct {
+	bearerToken       string
+	bearerTokenFile   string
+	basicAuthUsername string
+	basicAuthPassword string
+	headers           map[string]string
 }
 
-func decodeContent(client *http.Client, url string, ch chan<- *dto.MetricFamily) {
+// apply sets the additional headers and the Authorization header on the request.
+// The bearer token file is read on every call so that rotated tokens (e.g. Kubernetes service account tokens) are picked up
+func (a *scrapeAuth) apply(req *http.Request) error {
+	if a == nil {
+		return nil
+	}
+
+	for k, v := range a.headers {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	if a.basicAuthUsername != "" {
+		req.SetBasicAuth(a.basicAuthUsername, a.basicAuthPassword)
+	}
+
+	token := a.bearerToken
+	if a.bearerTokenFile != "" {
+		content, err := ioutil.ReadFile(a.bearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("reading bearer token file %q failed: %s", a.bearerTokenFile, err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+func decodeContent(ctx context.Context, client *http.Client, url string, auth *scrapeAuth) ([]*dto.MetricFamily, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		log.Fatalf("prometheus-to-cloudwatch: Error: creating GET request for URL %q failed: %s", url, err)
+		return nil, fmt.Errorf("creating GET request for URL %q failed: %s", url, err)
 	}
+	req = req.WithContext(ctx)
 	req.Header.Add("Accept", acceptHeader)
+	if err := auth.apply(req); err != nil {
+		return nil, fmt.Errorf("authenticating GET request for URL %q failed: %s", url, err)
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("prometheus-to-cloudwatch: Error: executing GET request for URL %q failed: %s", url, err)
+		return nil, fmt.Errorf("executing GET request for URL %q failed: %s", url, err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("prometheus-to-cloudwatch: Error: GET request for URL %q returned HTTP status %s", url, resp.Status)
+		return nil, fmt.Errorf("GET request for URL %q returned HTTP status %s", url, resp.Status)
 	}
-	parseResponse(resp, ch)
+	return parseResponse(resp)
 }
 
-// parseResponse consumes an http.Response and pushes it to the channel.
-// It returns when all all MetricFamilies are parsed and put on the channel.
-func parseResponse(resp *http.Response, ch chan<- *dto.MetricFamily) {
-	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+// parseResponse decodes the MetricFamilies of an http.Response
+func parseResponse(resp *http.Response) ([]*dto.MetricFamily, error) {
+	metricFamilies, err := decodeMetricFamilies(resp.Header.Get("Content-Type"), resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding response failed: %s", err)
+	}
+	return metricFamilies, nil
+}
+
+// decodeMetricFamilies decodes an exposition in the format given by the content type:
+// delimited protocol buffers, OpenMetrics, or the Prometheus text format otherwise
+func decodeMetricFamilies(contentType string, r io.Reader) ([]*dto.MetricFamily, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
 
 	if err == nil && mediaType == "application/vnd.google.protobuf" && params["encoding"] == "delimited" && params["proto"] == "io.prometheus.client.MetricFamily" {
+		var metricFamilies []*dto.MetricFamily
 		for {
 			mf := &dto.MetricFamily{}
-			if _, err = pbutil.ReadDelimited(resp.Body, mf); err != nil {
+			if _, err = pbutil.ReadDelimited(r, mf); err != nil {
 				if err == io.EOF {
 					break
 				}
-				log.Fatalln("prometheus-to-cloudwatch: Error: reading metric family protocol buffer failed:", err)
+				return nil, fmt.Errorf("reading metric family protocol buffer failed: %s", err)
 			}
-			ch <- mf
+			metricFamilies = append(metricFamilies, mf)
 		}
-	} else {
-		var parser expfmt.TextParser
-		metricFamilies, err := parser.TextToMetricFamilies(resp.Body)
+		return metricFamilies, nil
+	} else if err == nil && mediaType == expfmt.OpenMetricsType {
+		metricFamilies, err := parseOpenMetrics(r)
 		if err != nil {
-			log.Fatalln("reading text format failed:", err)
-		}
-		for _, mf := range metricFamilies {
-			ch <- mf
+			return nil, fmt.Errorf("reading OpenMetrics format failed: %s", err)
 		}
+		return metricFamilies, nil
+	}
+
+	var parser expfmt.TextParser
+	metricFamiliesByName, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading text format failed: %s", err)
+	}
+	metricFamilies := make([]*dto.MetricFamily, 0, len(metricFamiliesByName))
+	for _, mf := range metricFamiliesByName {
+		metricFamilies = append(metricFamilies, mf)
 	}
+	return metricFamilies, nil
 }
@@ -0,0 +1,798 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/gobwas/glob"
+	"github.com/prometheus/common/model"
+)
+
+// fakeCloudWatch records the PutMetricData requests it receives, or fails them while failing is set.
+// Requests with a datum named `rejected` are rejected as invalid. Each request takes `delay` to answer,
+// and the arrival times and the maximum number of concurrent requests are recorded
+type fakeCloudWatch struct {
+	*httptest.Server
+	mtx         sync.Mutex
+	requests    []url.Values
+	failing     bool
+	rejected    string
+	delay       time.Duration
+	arrivals    []time.Time
+	inFlight    int
+	maxInFlight int
+}
+
+// newFakeCloudWatch starts a fake CloudWatch, closed at the end of the test
+func newFakeCloudWatch(t *testing.T) *fakeCloudWatch {
+	cw := &fakeCloudWatch{}
+	cw.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw.mtx.Lock()
+		cw.arrivals = append(cw.arrivals, time.Now())
+		cw.inFlight++
+		if cw.inFlight > cw.maxInFlight {
+			cw.maxInFlight = cw.inFlight
+		}
+		delay := cw.delay
+		cw.mtx.Unlock()
+		defer func() {
+			cw.mtx.Lock()
+			cw.inFlight--
+			cw.mtx.Unlock()
+		}()
+		time.Sleep(delay)
+
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("PutMetricData body is not compressed: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(zr)
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cw.mtx.Lock()
+		failing := cw.failing
+		rejected := cw.rejected != "" && hasMetricName(form, cw.rejected)
+		if !failing && !rejected {
+			cw.requests = append(cw.requests, form)
+		}
+		cw.mtx.Unlock()
+		w.Header().Set("Content-Type", "text/xml")
+		if rejected {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>InvalidParameterValue</Code><Message>invalid value</Message></Error><RequestId>1</RequestId></ErrorResponse>`))
+			return
+		}
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`<ErrorResponse><Error><Type>Receiver</Type><Code>InternalFailure</Code><Message>unavailable</Message></Error><RequestId>1</RequestId></ErrorResponse>`))
+			return
+		}
+		_, _ = w.Write([]byte(`<PutMetricDataResponse xmlns="http://monitoring.amazonaws.com/doc/2010-08-01/"><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></PutMetricDataResponse>`))
+	}))
+	t.Cleanup(cw.Close)
+	return cw
+}
+
+// newTextExporter serves the exposition in the Prometheus text format, until the end of the test
+func newTextExporter(t *testing.T, exposition string) *httptest.Server {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(exposition))
+	}))
+	t.Cleanup(exporter.Close)
+	return exporter
+}
+
+// hasMetricName reports whether the PutMetricData request has a datum with the name
+func hasMetricName(form url.Values, name string) bool {
+	for k, v := range form {
+		if strings.HasPrefix(k, "MetricData.member.") && strings.HasSuffix(k, ".MetricName") && v[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// metricNames returns the sorted names of the published datums
+func (cw *fakeCloudWatch) metricNames() []string {
+	cw.mtx.Lock()
+	defer cw.mtx.Unlock()
+
+	var names []string
+	for _, form := range cw.requests {
+		for k, v := range form {
+			if strings.HasPrefix(k, "MetricData.member.") && strings.HasSuffix(k, ".MetricName") {
+				names = append(names, v[0])
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setFailing makes the following requests fail, or succeed again
+func (cw *fakeCloudWatch) setFailing(failing bool) {
+	cw.mtx.Lock()
+	defer cw.mtx.Unlock()
+	cw.failing = failing
+}
+
+// reset forgets the recorded requests
+func (cw *fakeCloudWatch) reset() {
+	cw.mtx.Lock()
+	defer cw.mtx.Unlock()
+	cw.requests = nil
+}
+
+// newTestBridge creates a bridge publishing to the fake CloudWatch
+func newTestBridge(t *testing.T, c *Config, cw *fakeCloudWatch) *Bridge {
+	c.CloudWatchNamespace = "test"
+	c.CloudWatchRegion = "us-east-1"
+	b, err := NewBridge(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.destinations[0].cw = newFakeCloudWatchClient(t, c.CloudWatchRegion, cw)
+	return b
+}
+
+// newFakeCloudWatchClient creates a CloudWatch client sending its requests to the fake CloudWatch
+func newFakeCloudWatchClient(t *testing.T, region string, cw *fakeCloudWatch) *cloudwatch.CloudWatch {
+	sess, err := session.NewSession(aws.NewConfig().
+		WithRegion(region).
+		WithEndpoint(cw.URL).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithMaxRetries(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cloudwatch.New(sess)
+}
+
+func TestPublishOnce(t *testing.T) {
+	exporter := newTextExporter(t, "# TYPE up gauge\nup 1\n# TYPE http_requests_total counter\nhttp_requests_total{code=\"200\"} 3\n")
+	cw := newFakeCloudWatch(t)
+
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL}, cw)
+	count, err := b.PublishOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("published %d metrics, want 2", count)
+	}
+	if got, want := strings.Join(cw.metricNames(), ","), "http_requests_total,up"; got != want {
+		t.Errorf("published %s, want %s", got, want)
+	}
+	if ns := cw.requests[0].Get("Namespace"); ns != "test" {
+		t.Errorf("published into namespace %q, want test", ns)
+	}
+}
+
+func TestPublishOnceScrapeError(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer exporter.Close()
+	cw := newFakeCloudWatch(t)
+
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL}, cw)
+	count, err := b.PublishOnce(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("error = %v, want the HTTP status of the scrape", err)
+	}
+	if count != 0 || len(cw.requests) != 0 {
+		t.Errorf("published %d metrics in %d requests, want none", count, len(cw.requests))
+	}
+}
+
+func TestPublishOnceInvalidExposition(t *testing.T) {
+	exporter := newTextExporter(t, "up{ 1\n")
+	cw := newFakeCloudWatch(t)
+
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL}, cw)
+	if _, err := b.PublishOnce(context.Background()); err == nil || !strings.Contains(err.Error(), "decoding response failed") {
+		t.Errorf("error = %v, want a decoding error", err)
+	}
+}
+
+func TestNewBridgeRejectsReceiversInLambda(t *testing.T) {
+	os.Setenv("AWS_LAMBDA_FUNCTION_NAME", "prometheus-to-cloudwatch")
+	defer os.Unsetenv("AWS_LAMBDA_FUNCTION_NAME")
+
+	for _, c := range []*Config{
+		{RemoteWriteReceiver: true},
+		{PushReceiver: true},
+		{OTLPReceiver: true},
+		{StatsdListenAddress: ":8125"},
+	} {
+		c.CloudWatchNamespace = "test"
+		c.CloudWatchRegion = "us-east-1"
+		if _, err := NewBridge(c); err == nil || !strings.Contains(err.Error(), "not available in Lambda") {
+			t.Errorf("NewBridge(%+v) error = %v, want the receivers rejected", c, err)
+		}
+	}
+
+	c := &Config{CloudWatchNamespace: "test", CloudWatchRegion: "us-east-1", PrometheusScrapeUrl: "http://localhost:9100/metrics"}
+	if _, err := NewBridge(c); err != nil {
+		t.Errorf("NewBridge error = %v, want a scrape-only bridge accepted", err)
+	}
+}
+
+func TestNewBridgeRejectsSkipCertCheckWithVerification(t *testing.T) {
+	for _, c := range []*Config{
+		{PrometheusCAPath: "ca.pem"},
+		{PrometheusServerName: "prometheus"},
+		{PrometheusMinTLSVersion: tls.VersionTLS12},
+	} {
+		c.CloudWatchNamespace = "test"
+		c.CloudWatchRegion = "us-east-1"
+		c.PrometheusScrapeUrl = "https://localhost:9100/metrics"
+		c.PrometheusSkipServerCertCheck = true
+		if _, err := NewBridge(c); err == nil || !strings.Contains(err.Error(), "PrometheusSkipServerCertCheck can't be combined") {
+			t.Errorf("NewBridge(%+v) error = %v, want the conflicting options rejected", c, err)
+		}
+	}
+}
+
+func TestPublishOnceScrapeDeadline(t *testing.T) {
+	release := make(chan struct{})
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer exporter.Close()
+	defer close(release)
+	cw := newFakeCloudWatch(t)
+
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL, PublishCycleTimeout: 100 * time.Millisecond}, cw)
+	start := time.Now()
+	_, err := b.PublishOnce(context.Background())
+	if err == nil {
+		t.Error("PublishOnce succeeded, want the scrape interrupted")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("PublishOnce took %s, want the scrape cancelled at the cycle deadline", elapsed)
+	}
+}
+
+func TestSanitizeDimensionString(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		in, want string
+	}{
+		{"web-1", "web-1"},
+		{" \t", ""},
+		{"café", "caf__a82b5049"},
+		{"cafë", "caf__a62b4d23"},
+		{"line\nbreak", "line_break_1f7562aa"},
+		{long, long[:246] + "_279e8f01"},
+		{strings.Repeat("é", 250), strings.Repeat("_", 246) + "_b293233d"},
+	}
+	for _, tt := range tests {
+		got := sanitizeDimensionString(tt.in, cwMaxDimensionNameLength)
+		if got != tt.want {
+			t.Errorf("sanitizeDimensionString(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if len(got) > cwMaxDimensionNameLength {
+			t.Errorf("sanitizeDimensionString(%q) is %d characters long", tt.in, len(got))
+		}
+	}
+}
+
+func TestTruncatedSeriesPruned(t *testing.T) {
+	b, err := NewBridge(&Config{CloudWatchNamespace: "test", CloudWatchRegion: "us-east-1", PrometheusScrapeUrl: "http://localhost:9100/metrics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := model.Metric{"__name__": "kept"}
+	gone := model.Metric{"__name__": "gone"}
+
+	b.warnTruncatedDimensions(kept, []string{"a"})
+	b.warnTruncatedDimensions(gone, []string{"a"})
+	b.rotateTruncatedSeries()
+	b.warnTruncatedDimensions(kept, []string{"a"})
+	b.rotateTruncatedSeries()
+
+	if !b.truncatedSeries[kept.Fingerprint()] || b.truncatedSeries[gone.Fingerprint()] || len(b.truncatedSeries) != 1 {
+		t.Errorf("truncated series = %v, want only the series of the last cycle", b.truncatedSeries)
+	}
+}
+
+func TestGetAdditionalDimensions(t *testing.T) {
+	os.Setenv("PROMETHEUS_TO_CLOUDWATCH_TEST_STAGE", "prod")
+	defer os.Unsetenv("PROMETHEUS_TO_CLOUDWATCH_TEST_STAGE")
+
+	mustTemplate := func(name, value string) AdditionalDimension {
+		d, err := NewAdditionalDimension(name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	mustStatic := func(name, value string) AdditionalDimension {
+		d, err := NewStaticDimension(name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	tests := []struct {
+		name string
+		dim  AdditionalDimension
+		want string
+	}{
+		{"static", mustStatic("Env", "production"), "Env=production"},
+		{"static value with comma and braces", mustStatic("Team", "a,b {{ .Hostname }}"), "Team=a,b {{ .Hostname }}"},
+		{"label", mustTemplate("Service", "{{ .Labels.job }}"), "Service=api"},
+		{"label and env", mustTemplate("Service", `{{ .Labels.job }}-{{ env "PROMETHEUS_TO_CLOUDWATCH_TEST_STAGE" }}`), "Service=api-prod"},
+		{"hostname", mustTemplate("Host", "{{ .Hostname }}"), "Host=web-1"},
+		{"missing label renders empty and is skipped", mustTemplate("Zone", "{{ .Labels.zone }}"), ""},
+		{"failing template is skipped", mustTemplate("Bad", "{{ .Missing }}"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Bridge{additionalDimensions: []AdditionalDimension{tt.dim}, hostname: "web-1"}
+			var got []string
+			for _, d := range getAdditionalDimensions(model.Metric{"__name__": "up", "job": "api"}, b) {
+				got = append(got, *d.Name+"="+*d.Value)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("dimensions = %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewAdditionalDimensionInvalid(t *testing.T) {
+	if _, err := NewAdditionalDimension("", "value"); err == nil {
+		t.Error("NewAdditionalDimension accepted an empty name")
+	}
+	if _, err := NewAdditionalDimension("Service", "{{ .Labels.job"); err == nil {
+		t.Error("NewAdditionalDimension accepted an invalid template")
+	}
+	if _, err := NewStaticDimension("", "value"); err == nil {
+		t.Error("NewStaticDimension accepted an empty name")
+	}
+}
+
+func TestPublishOnceNamespaces(t *testing.T) {
+	var exposition strings.Builder
+	for i := 0; i < 12; i++ {
+		fmt.Fprintf(&exposition, "queue_depth{queue=\"q%d\",cw_namespace=\"Team/A\"} 1\n", i)
+	}
+	exposition.WriteString("reserved{cw_namespace=\"AWS/EC2\"} 1\n")
+	exposition.WriteString("unicode{cw_namespace=\"Équipe\"} 1\n")
+	exposition.WriteString("kafka_lag{cw_namespace=\"\"} 1\n")
+	exposition.WriteString("up 1\n")
+	exporter := newTextExporter(t, exposition.String())
+	cw := newFakeCloudWatch(t)
+
+	b := newTestBridge(t, &Config{
+		PrometheusScrapeUrl: exporter.URL,
+		NamespaceLabel:      "cw_namespace",
+		NamespaceRules:      []NamespaceRule{{Matcher: glob.MustCompile("kafka_*"), Namespace: "Kafka"}},
+	}, cw)
+	if _, err := b.PublishOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each request publishes into a single namespace, in batches of up to batchSize datums
+	requests := make(map[string][]int)
+	names := make(map[string][]string)
+	for _, form := range cw.requests {
+		ns := form.Get("Namespace")
+		n := 0
+		for k, v := range form {
+			if strings.HasPrefix(k, "MetricData.member.") && strings.HasSuffix(k, ".MetricName") {
+				names[ns] = append(names[ns], v[0])
+				n++
+			}
+		}
+		requests[ns] = append(requests[ns], n)
+	}
+	for _, sizes := range requests {
+		sort.Ints(sizes)
+	}
+	for ns := range names {
+		sort.Strings(names[ns])
+	}
+
+	wantRequests := map[string][]int{"Team/A": {2, 10}, "Kafka": {1}, "test": {3}}
+	if !reflect.DeepEqual(requests, wantRequests) {
+		t.Errorf("requests per namespace = %v, want %v", requests, wantRequests)
+	}
+	wantNames := map[string][]string{
+		"Kafka": {"kafka_lag"},
+		"test":  {"reserved", "unicode", "up"},
+	}
+	for ns, want := range wantNames {
+		if !reflect.DeepEqual(names[ns], want) {
+			t.Errorf("published %v into %s, want %v", names[ns], ns, want)
+		}
+	}
+	for _, form := range cw.requests {
+		for k, v := range form {
+			if strings.Contains(k, ".Dimensions.member.") && strings.HasSuffix(k, ".Name") && v[0] == "cw_namespace" {
+				t.Fatal("published the namespace label as a dimension")
+			}
+		}
+	}
+}
+
+func TestSetDatumValue(t *testing.T) {
+	aggregated := &statistics{min: 1, max: 5, sum: 9, count: 3}
+	tests := []struct {
+		name          string
+		st            *statistics
+		statisticSets bool
+		wantValue     *float64
+		wantStats     *cloudwatch.StatisticSet
+	}{
+		{"single sample", nil, false, aws.Float64(5), nil},
+		{"single aggregated sample", &statistics{min: 5, max: 5, sum: 5, count: 1}, false, aws.Float64(5), nil},
+		{"aggregated samples", aggregated, false, nil, &cloudwatch.StatisticSet{Minimum: aws.Float64(1), Maximum: aws.Float64(5), Sum: aws.Float64(9), SampleCount: aws.Float64(3)}},
+		{"statistic sets with a single sample", nil, true, nil, &cloudwatch.StatisticSet{Minimum: aws.Float64(5), Maximum: aws.Float64(5), Sum: aws.Float64(5), SampleCount: aws.Float64(1)}},
+		{"statistic sets with aggregated samples", aggregated, true, nil, &cloudwatch.StatisticSet{Minimum: aws.Float64(1), Maximum: aws.Float64(5), Sum: aws.Float64(9), SampleCount: aws.Float64(3)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datum := &cloudwatch.MetricDatum{}
+			setDatumValue(datum, 5, tt.st, tt.statisticSets)
+			if !reflect.DeepEqual(datum.Value, tt.wantValue) || !reflect.DeepEqual(datum.StatisticValues, tt.wantStats) {
+				t.Errorf("datum = %v, want value %v and statistics %v", datum, aws.Float64Value(tt.wantValue), tt.wantStats)
+			}
+		})
+	}
+}
+
+func TestGetDimensionsOrderAndTruncation(t *testing.T) {
+	labels := model.Metric{"__name__": "kafka_lag", "topic": "orders", "partition": "3", "broker": "b1", "app": "api", "zone": "a"}
+	priorities := []MatcherWithStringList{
+		{Matcher: glob.MustCompile("kafka_*"), List: []string{"topic", "partition"}},
+		{Matcher: glob.MustCompile("*"), List: []string{"zone"}},
+	}
+	tests := []struct {
+		name        string
+		num         int
+		priorities  []MatcherWithStringList
+		metric      model.Metric
+		want        string
+		wantDropped bool
+	}{
+		{"alphabetical", 30, nil, labels, "app,broker,partition,topic,zone", false},
+		{"priorities first", 30, priorities, labels, "topic,partition,app,broker,zone", false},
+		{"priorities of the first matching pattern", 30, priorities, model.Metric{"__name__": "http_requests", "zone": "a", "app": "api"}, "zone,app", false},
+		{"truncated alphabetically", 2, nil, labels, "app,broker", true},
+		{"truncated after the priorities", 3, priorities, labels, "topic,partition,app", true},
+		{"priority labels missing from the metric", 2, priorities, model.Metric{"__name__": "kafka_up", "broker": "b1", "app": "api", "zone": "a"}, "app,broker", true},
+		{"exactly at the limit", 5, nil, labels, "app,broker,partition,topic,zone", false},
+		{"no room left", 0, nil, labels, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewBridge(&Config{CloudWatchNamespace: "test", CloudWatchRegion: "us-east-1", PrometheusScrapeUrl: "http://localhost:9100/metrics", DimensionPriorities: tt.priorities})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dims, _ := getDimensions(tt.metric, tt.num, b)
+			var names []string
+			for _, d := range dims {
+				names = append(names, *d.Name)
+			}
+			if got := strings.Join(names, ","); got != tt.want {
+				t.Errorf("dimensions = %s, want %s", got, tt.want)
+			}
+			if dropped := len(b.truncatedSeriesCycle) > 0; dropped != tt.wantDropped {
+				t.Errorf("truncation reported = %t, want %t", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestPublishOnceMaxDimensions(t *testing.T) {
+	exporter := newTextExporter(t, "up{a=\"1\",b=\"2\",c=\"3\",d=\"4\"} 1\n")
+	cw := newFakeCloudWatch(t)
+
+	env, err := NewStaticDimension("Env", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL, MaxDimensions: 3, AdditionalDimensions: []AdditionalDimension{env}}, cw)
+	if _, err := b.PublishOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The additional dimensions count towards the limit
+	var got []string
+	for i := 1; ; i++ {
+		name := cw.requests[0].Get(fmt.Sprintf("MetricData.member.1.Dimensions.member.%d.Name", i))
+		if name == "" {
+			break
+		}
+		got = append(got, name)
+	}
+	if want := "a,b,Env"; strings.Join(got, ",") != want {
+		t.Errorf("dimensions = %v, want %s", got, want)
+	}
+}
+
+func TestAdditionalDimensionListParse(t *testing.T) {
+	dims := additionalDimensionListMustParse(`Service={{ printf "%s,%s" .Labels.job .Labels.zone }};Host={{ .Hostname }}`, "-additional_dimensions")
+	b := &Bridge{additionalDimensions: dims, hostname: "web-1"}
+
+	var got []string
+	for _, d := range getAdditionalDimensions(model.Metric{"__name__": "up", "job": "api", "zone": "a"}, b) {
+		got = append(got, *d.Name+"="+*d.Value)
+	}
+	if want := "Service=api,a;Host=web-1"; strings.Join(got, ";") != want {
+		t.Errorf("dimensions = %v, want %s", got, want)
+	}
+}
+
+// newAuthExporter serves `up 1` and records the requests it receives
+func newAuthExporter(t *testing.T) (*httptest.Server, func() []*http.Request) {
+	var mtx sync.Mutex
+	var requests []*http.Request
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		requests = append(requests, r)
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	t.Cleanup(exporter.Close)
+	return exporter, func() []*http.Request {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return requests
+	}
+}
+
+func TestScrapeBearerTokenFileRotation(t *testing.T) {
+	exporter, requests := newAuthExporter(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL, PrometheusBearerTokenFile: tokenFile}, newFakeCloudWatch(t))
+
+	if _, err := b.PublishOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The rotated token is used by the next scrape
+	if err := ioutil.WriteFile(tokenFile, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.PublishOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, r := range requests() {
+		got = append(got, r.Header.Get("Authorization"))
+	}
+	if want := []string{"Bearer first", "Bearer second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Authorization headers = %q, want %q", got, want)
+	}
+}
+
+func TestScrapeAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		check  func(r *http.Request) error
+	}{
+		{
+			name:   "bearer token",
+			config: Config{PrometheusBearerToken: "secret"},
+			check: func(r *http.Request) error {
+				if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+					return fmt.Errorf("Authorization = %q, want the bearer token", got)
+				}
+				return nil
+			},
+		},
+		{
+			name:   "basic auth",
+			config: Config{PrometheusBasicAuthUsername: "user", PrometheusBasicAuthPassword: "pass:word"},
+			check: func(r *http.Request) error {
+				if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass:word" {
+					return fmt.Errorf("basic auth = %q, %q, %t, want user and pass:word", user, pass, ok)
+				}
+				return nil
+			},
+		},
+		{
+			name:   "custom headers",
+			config: Config{PrometheusHeaders: map[string]string{"X-Scope-OrgID": "tenant-1", "Host": "exporter.internal"}},
+			check: func(r *http.Request) error {
+				if got := r.Header.Get("X-Scope-OrgID"); got != "tenant-1" {
+					return fmt.Errorf("X-Scope-OrgID = %q, want tenant-1", got)
+				}
+				if r.Host != "exporter.internal" {
+					return fmt.Errorf("Host = %q, want exporter.internal", r.Host)
+				}
+				if got := r.Header.Get("Authorization"); got != "" {
+					return fmt.Errorf("Authorization = %q, want none", got)
+				}
+				return nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter, requests := newAuthExporter(t)
+			c := tt.config
+			c.PrometheusScrapeUrl = exporter.URL
+			b := newTestBridge(t, &c, newFakeCloudWatch(t))
+			if _, err := b.PublishOnce(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if len(requests()) != 1 {
+				t.Fatalf("received %d scrapes, want 1", len(requests()))
+			}
+			if err := tt.check(requests()[0]); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestScrapeBearerTokenFileMissing(t *testing.T) {
+	exporter, requests := newAuthExporter(t)
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL, PrometheusBearerTokenFile: filepath.Join(t.TempDir(), "missing")}, newFakeCloudWatch(t))
+	if _, err := b.PublishOnce(context.Background()); err == nil || !strings.Contains(err.Error(), "reading bearer token file") {
+		t.Errorf("error = %v, want the token file error", err)
+	}
+	if len(requests()) != 0 {
+		t.Error("scraped without the bearer token")
+	}
+}
+
+// newTLSExporter serves `up 1` over HTTPS, requesting a client certificate, and reports whether the last scrape
+// presented one. The certificate of the server (valid for example.com and 127.0.0.1) is written to a CA bundle
+func newTLSExporter(t *testing.T) (exporter *httptest.Server, caPath string, clientCert func() bool) {
+	var presented bool
+	exporter = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented = len(r.TLS.PeerCertificates) > 0
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	exporter.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	exporter.StartTLS()
+	t.Cleanup(exporter.Close)
+
+	caPath = filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caPath, "CERTIFICATE", exporter.Certificate().Raw)
+	return exporter, caPath, func() bool { return presented }
+}
+
+// writePEM writes a PEM block to the file
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newClientKeyPair writes a self-signed client certificate and its key, and returns their paths
+func newClientKeyPair(t *testing.T) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "prometheus-to-cloudwatch"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writePEM(t, certPath, "CERTIFICATE", der)
+	writePEM(t, keyPath, "EC PRIVATE KEY", keyDer)
+	return certPath, keyPath
+}
+
+func TestScrapeTLS(t *testing.T) {
+	exporter, caPath, _ := newTLSExporter(t)
+
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "CA bundle", config: Config{PrometheusCAPath: caPath}},
+		{name: "no CA bundle", config: Config{}, wantErr: true},
+		{name: "no CA bundle, verification skipped", config: Config{PrometheusSkipServerCertCheck: true}},
+		{name: "server name of the certificate", config: Config{PrometheusCAPath: caPath, PrometheusServerName: "example.com"}},
+		{name: "server name not in the certificate", config: Config{PrometheusCAPath: caPath, PrometheusServerName: "prometheus.internal"}, wantErr: true},
+		{name: "minimum TLS version", config: Config{PrometheusCAPath: caPath, PrometheusMinTLSVersion: tls.VersionTLS12}},
+		{name: "missing CA bundle", config: Config{PrometheusCAPath: filepath.Join(t.TempDir(), "missing.pem")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config
+			c.PrometheusScrapeUrl = exporter.URL
+			cw := newFakeCloudWatch(t)
+			b := newTestBridge(t, &c, cw)
+
+			_, err := b.PublishOnce(context.Background())
+			if tt.wantErr {
+				if err == nil || len(cw.requests) != 0 {
+					t.Errorf("error = %v, published %v, want the scrape to fail", err, cw.metricNames())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cw.metricNames(); len(got) != 1 || got[0] != "up" {
+				t.Errorf("published %v, want up", got)
+			}
+		})
+	}
+}
+
+func TestScrapeTLSClientCertificate(t *testing.T) {
+	exporter, caPath, clientCert := newTLSExporter(t)
+	certPath, keyPath := newClientKeyPair(t)
+
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL, PrometheusCAPath: caPath}, newFakeCloudWatch(t))
+	if _, err := b.PublishOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if clientCert() {
+		t.Error("presented a client certificate, want none without PrometheusCertPath")
+	}
+
+	b = newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL, PrometheusCAPath: caPath, PrometheusCertPath: certPath, PrometheusKeyPath: keyPath}, newFakeCloudWatch(t))
+	if _, err := b.PublishOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !clientCert() {
+		t.Error("presented no client certificate, want the configured one")
+	}
+}
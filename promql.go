@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// PromQLQuery defines a named PromQL query. The samples of its result are published with the query name as metric name,
+// and the result labels as dimensions
+type PromQLQuery struct {
+	Name string
+	Expr string
+}
+
+// queryResponse is the response of the Prometheus /api/v1/query endpoint
+type queryResponse struct {
+	Status    string          `json:"status"`
+	ErrorType string          `json:"errorType"`
+	Error     string          `json:"error"`
+	Data      json.RawMessage `json:"data"`
+}
+
+type queryData struct {
+	ResultType model.ValueType `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// queryPrometheus runs the configured PromQL queries and returns the samples of their results.
+// Failing queries are logged and skipped so that one bad query doesn't prevent publishing the others
+func (b *Bridge) queryPrometheus(ctx context.Context, now model.Time) model.Vector {
+	tlsConfig, err := b.queryTLS.config()
+	if err != nil {
+		log.Println("prometheus-to-cloudwatch: error querying Prometheus:", err)
+		return nil
+	}
+	// A cycle's queries must not outlast the interval
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   b.prometheusScrapeInterval,
+	}
+	defer client.CloseIdleConnections()
+
+	var vec model.Vector
+	for _, q := range b.prometheusQueries {
+		samples, err := runQuery(ctx, client, b.prometheusQueryUrl, q, now, b.queryAuth)
+		if err != nil {
+			log.Printf("prometheus-to-cloudwatch: error running query %q: %s", q.Name, err)
+			continue
+		}
+		vec = append(vec, samples...)
+	}
+	return vec
+}
+
+// sameOrigin reports whether both URLs have the same scheme and host
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil || ua.Host == "" {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// runQuery evaluates an instant query at `now` and returns its result as samples named after the query
+func runQuery(ctx context.Context, client *http.Client, baseUrl string, q PromQLQuery, now model.Time, auth *scrapeAuth) (model.Vector, error) {
+	params := url.Values{}
+	params.Set("query", q.Expr)
+	params.Set("time", now.String())
+	u := strings.TrimSuffix(baseUrl, "/") + "/api/v1/query?" + params.Encode()
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if err := auth.apply(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var qr queryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&qr); err != nil {
+		return nil, fmt.Errorf("decoding response with HTTP status %s failed: %s", resp.Status, err)
+	}
+	if qr.Status != "success" {
+		return nil, fmt.Errorf("%s: %s", qr.ErrorType, qr.Error)
+	}
+
+	var data queryData
+	if err := json.Unmarshal(qr.Data, &data); err != nil {
+		return nil, err
+	}
+
+	var vec model.Vector
+	switch data.ResultType {
+	case model.ValVector:
+		if err := json.Unmarshal(data.Result, &vec); err != nil {
+			return nil, err
+		}
+	case model.ValScalar:
+		var scalar model.Scalar
+		if err := json.Unmarshal(data.Result, &scalar); err != nil {
+			return nil, err
+		}
+		vec = model.Vector{{Metric: model.Metric{}, Value: scalar.Value, Timestamp: scalar.Timestamp}}
+	default:
+		return nil, fmt.Errorf("unsupported result type %q, only vector and scalar results can be published", data.ResultType)
+	}
+
+	for _, s := range vec {
+		s.Metric[model.MetricNameLabel] = model.LabelValue(q.Name)
+	}
+	return vec, nil
+}
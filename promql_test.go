@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestRunQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     model.Vector
+		wantErr  string
+	}{
+		{
+			name:     "vector",
+			response: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"node"},"value":[1600000000,"1"]},{"metric":{"job":"api"},"value":[1600000000,"0.5"]}]}}`,
+			want: model.Vector{
+				{Metric: model.Metric{"__name__": "availability", "job": "node"}, Value: 1, Timestamp: 1600000000000},
+				{Metric: model.Metric{"__name__": "availability", "job": "api"}, Value: 0.5, Timestamp: 1600000000000},
+			},
+		},
+		{
+			name:     "scalar",
+			response: `{"status":"success","data":{"resultType":"scalar","result":[1600000000.5,"42"]}}`,
+			want: model.Vector{
+				{Metric: model.Metric{"__name__": "availability"}, Value: 42, Timestamp: 1600000000500},
+			},
+		},
+		{
+			name:     "empty vector",
+			response: `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+			want:     model.Vector{},
+		},
+		{
+			name:     "error status",
+			response: `{"status":"error","errorType":"bad_data","error":"parse error at char 4"}`,
+			wantErr:  "bad_data: parse error at char 4",
+		},
+		{
+			name:     "matrix",
+			response: `{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+			wantErr:  `unsupported result type "matrix"`,
+		},
+		{
+			name:     "invalid JSON",
+			response: `<html>`,
+			wantErr:  "decoding response with HTTP status 200 OK failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query, at string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v1/query" {
+					http.NotFound(w, r)
+					return
+				}
+				query, at = r.URL.Query().Get("query"), r.URL.Query().Get("time")
+				_, _ = w.Write([]byte(tt.response))
+			}))
+			defer srv.Close()
+
+			q := PromQLQuery{Name: "availability", Expr: `avg by (job) (up)`}
+			got, err := runQuery(context.Background(), srv.Client(), srv.URL+"/", q, 1600000000000, nil)
+			if query != q.Expr || at != "1600000000" {
+				t.Errorf("query=%q time=%q, want %q and 1600000000", query, at, q.Expr)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunQueryAuth(t *testing.T) {
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	auth := &scrapeAuth{bearerToken: "secret"}
+	if _, err := runQuery(context.Background(), srv.Client(), srv.URL, PromQLQuery{Name: "q", Expr: "up"}, 0, auth); err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "Bearer secret" {
+		t.Errorf("Authorization = %q, want the bearer token", authorization)
+	}
+}
+
+func TestQueryCredentials(t *testing.T) {
+	tests := []struct {
+		scrapeUrl, queryUrl string
+		want                bool
+	}{
+		{"https://prometheus:9090/federate", "https://prometheus:9090", true},
+		{"https://Prometheus:9090/metrics", "https://prometheus:9090/", true},
+		{"https://node:9100/metrics", "https://prometheus:9090", false},
+		{"https://prometheus:9090/metrics", "http://prometheus:9090", false},
+		{"", "https://prometheus:9090", true},
+	}
+	for _, tt := range tests {
+		b, err := NewBridge(&Config{
+			CloudWatchNamespace:   "test",
+			CloudWatchRegion:      "us-east-1",
+			PrometheusScrapeUrl:   tt.scrapeUrl,
+			PrometheusQueryUrl:    tt.queryUrl,
+			PrometheusQueries:     []PromQLQuery{{Name: "q", Expr: "up"}},
+			PrometheusBearerToken: "secret",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := b.queryAuth != nil; got != tt.want {
+			t.Errorf("scrape URL %q, query URL %q: credentials sent = %v, want %v", tt.scrapeUrl, tt.queryUrl, got, tt.want)
+		}
+	}
+}
+
+// TestQueryOnlyTLSAuth checks that without a scrape URL, the TLS and authentication settings are used for the queries
+func TestQueryOnlyTLSAuth(t *testing.T) {
+	var clientCert bool
+	var authorization, tenant string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCert = len(r.TLS.PeerCertificates) > 0
+		authorization, tenant = r.Header.Get("Authorization"), r.Header.Get("X-Scope-OrgID")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1600000000,"1"]}]}}`))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caPath, "CERTIFICATE", srv.Certificate().Raw)
+	certPath, keyPath := newClientKeyPair(t)
+
+	cw := newFakeCloudWatch(t)
+	b := newTestBridge(t, &Config{
+		PrometheusQueryUrl:    srv.URL,
+		PrometheusQueries:     []PromQLQuery{{Name: "availability", Expr: "up"}},
+		PrometheusCAPath:      caPath,
+		PrometheusCertPath:    certPath,
+		PrometheusKeyPath:     keyPath,
+		PrometheusBearerToken: "secret",
+		PrometheusHeaders:     map[string]string{"X-Scope-OrgID": "tenant-1"},
+	}, cw)
+
+	if _, err := b.PublishOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := cw.metricNames(); len(got) != 1 || got[0] != "availability" {
+		t.Errorf("published %v, want availability", got)
+	}
+	if !clientCert {
+		t.Error("presented no client certificate, want the configured one")
+	}
+	if authorization != "Bearer secret" || tenant != "tenant-1" {
+		t.Errorf("Authorization = %q, X-Scope-OrgID = %q, want the configured bearer token and header", authorization, tenant)
+	}
+}
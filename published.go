@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+// publishedValue is what was last published for a series: its value, and the time it was published at in publish
+// on change mode, or its exposed timestamp with HonorTimestamps
+type publishedValue struct {
+	value model.SampleValue
+	at    model.Time
+}
+
+// publishedSeries remembers what was last published for each series. Only the series of the last cycle are kept,
+// so that series which disappeared don't accumulate
+type publishedSeries struct {
+	mtx  sync.Mutex
+	last map[model.Fingerprint]publishedValue
+}
+
+// get returns what was last published for the series, and carries it over into `seen`, the series of the cycle
+func (p *publishedSeries) get(fp model.Fingerprint, seen map[model.Fingerprint]publishedValue) (publishedValue, bool) {
+	p.mtx.Lock()
+	last, ok := p.last[fp]
+	p.mtx.Unlock()
+
+	if ok {
+		seen[fp] = last
+	}
+	return last, ok
+}
+
+// keep forgets the series which weren't seen during the cycle. What is published during the cycle is recorded
+// afterwards, as the batches are sent (see record)
+func (p *publishedSeries) keep(seen map[model.Fingerprint]publishedValue) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.last = seen
+}
+
+// record records the values of a batch published to every destination as the last published values.
+// The values of failed batches aren't recorded, so that they are published again on the next cycle
+func (p *publishedSeries) record(published map[model.Fingerprint]publishedValue) {
+	if len(published) == 0 {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.last == nil {
+		p.last = make(map[model.Fingerprint]publishedValue, len(published))
+	}
+	for fp, v := range published {
+		p.last[fp] = v
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/glob"
+	"github.com/prometheus/common/model"
+)
+
+// TestPublishedSeriesRetriesFailedBatches checks that what is skipped as already published (unchanged values
+// in publish on change mode, exposed timestamps) is only recorded once its batch is published
+func TestPublishedSeriesRetriesFailedBatches(t *testing.T) {
+	ts := time.Now().Add(-time.Minute).UnixNano() / int64(time.Millisecond)
+
+	tests := []struct {
+		name       string
+		exposition string
+		config     Config
+	}{
+		{"publish on change", "up 1\n", Config{PublishOnChange: []glob.Glob{glob.MustCompile("up")}}},
+		{"honor timestamps", fmt.Sprintf("up 1 %d\n", ts), Config{HonorTimestamps: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := newTextExporter(t, tt.exposition)
+			cw := newFakeCloudWatch(t)
+
+			c := tt.config
+			c.PrometheusScrapeUrl = exporter.URL
+			b := newTestBridge(t, &c, cw)
+
+			cw.setFailing(true)
+			if _, err := b.PublishOnce(context.Background()); err == nil {
+				t.Fatal("PublishOnce succeeded, want the CloudWatch error")
+			}
+
+			// The sample was not published, so it must not be skipped as already published
+			cw.setFailing(false)
+			if _, err := b.PublishOnce(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(cw.metricNames(), ","); got != "up" {
+				t.Errorf("published %q after a failed cycle, want up", got)
+			}
+
+			// Once published, the same sample is skipped
+			cw.reset()
+			if _, err := b.PublishOnce(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := cw.metricNames(); len(got) != 0 {
+				t.Errorf("published %v, want the already published sample skipped", got)
+			}
+		})
+	}
+}
+
+func TestHonorTimestampsWindow(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) string {
+		return fmt.Sprintf("up 1 %d\n", now.Add(d).UnixNano()/int64(time.Millisecond))
+	}
+
+	tests := []struct {
+		name         string
+		exposition   string
+		maxSampleAge time.Duration
+		want         bool
+	}{
+		{"without timestamp", "up 1\n", time.Minute, true},
+		{"recent", at(-time.Minute), 0, true},
+		{"within max sample age", at(-30 * time.Second), time.Minute, true},
+		{"older than max sample age", at(-2 * time.Minute), time.Minute, false},
+		{"older than two weeks", at(-15 * 24 * time.Hour), 0, false},
+		{"max sample age beyond two weeks", at(-15 * 24 * time.Hour), 30 * 24 * time.Hour, false},
+		{"less than two hours ahead", at(time.Hour), 0, true},
+		{"more than two hours ahead", at(3 * time.Hour), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := newTextExporter(t, tt.exposition)
+			cw := newFakeCloudWatch(t)
+			b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL, HonorTimestamps: true, MaxSampleAge: tt.maxSampleAge}, cw)
+
+			if _, err := b.PublishOnce(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(cw.metricNames()) == 1; got != tt.want {
+				t.Errorf("published = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestHonorTimestampsAggregatedScrapes checks that samples scraped before the publish cycle without an exposed
+// timestamp are published with the publish time, rather than treated as exposed timestamps
+func TestHonorTimestampsAggregatedScrapes(t *testing.T) {
+	exporter := newTextExporter(t, "up 1\n")
+	cw := newFakeCloudWatch(t)
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: exporter.URL, HonorTimestamps: true, MaxSampleAge: time.Second}, cw)
+
+	now := model.Now()
+	if err := b.scrape(context.Background(), now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.publishCollected(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cw.metricNames(), ","); got != "up" {
+		t.Errorf("published %q, want the scraped sample", got)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// pushPath is the path prefix of the Pushgateway-compatible push receiver
+const pushPath = "/metrics/"
+
+// pushGroup holds the metrics pushed for a set of grouping labels
+type pushGroup struct {
+	labels   model.LabelSet
+	families map[string]*dto.MetricFamily
+	// Generation of the store when the group was last pushed to
+	generation uint64
+}
+
+// pushGeneration identifies the metrics of a group as collected by a publish cycle, so that a group pushed to
+// again while the cycle publishes isn't deleted with the collected metrics
+type pushGeneration struct {
+	key        string
+	generation uint64
+}
+
+// pushStore holds the metrics pushed to the bridge, grouped like the Pushgateway does by job and grouping labels
+type pushStore struct {
+	mtx        sync.Mutex
+	groups     map[string]*pushGroup
+	generation uint64
+}
+
+func newPushStore() *pushStore {
+	return &pushStore{groups: make(map[string]*pushGroup)}
+}
+
+// put replaces the metrics of the group. With `replaceAll`, all metrics of the group are replaced (PUT),
+// otherwise only the metrics with the same name as the pushed ones are (POST)
+func (ps *pushStore) put(labels model.LabelSet, mfs []*dto.MetricFamily, replaceAll bool) {
+	key := labels.String()
+
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	g, ok := ps.groups[key]
+	if !ok || replaceAll {
+		g = &pushGroup{labels: labels, families: make(map[string]*dto.MetricFamily, len(mfs))}
+		ps.groups[key] = g
+	}
+	for _, mf := range mfs {
+		g.families[mf.GetName()] = mf
+	}
+	ps.generation++
+	g.generation = ps.generation
+}
+
+// delete removes the metrics of the group
+func (ps *pushStore) delete(labels model.LabelSet) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	delete(ps.groups, labels.String())
+}
+
+// collect returns the samples of all pushed metrics with the grouping labels applied, and the group of each series.
+// The series of the samples pushed with a timestamp are added to `exposed`.
+// Groups without any sample (e.g. whose metrics can't be decoded) are deleted with `deleteEmpty`, as they would never be published
+func (ps *pushStore) collect(now model.Time, deleteEmpty bool, exposed timestampedSeries) (model.Vector, map[model.Fingerprint]pushGeneration, error) {
+	ps.mtx.Lock()
+	groups := make(map[string]pushGroup, len(ps.groups))
+	for key, g := range ps.groups {
+		// The families are copied, as a POST replaces them in the group
+		families := make(map[string]*dto.MetricFamily, len(g.families))
+		for name, mf := range g.families {
+			families[name] = mf
+		}
+		groups[key] = pushGroup{labels: g.labels, families: families, generation: g.generation}
+	}
+	ps.mtx.Unlock()
+
+	var vec model.Vector
+	series := make(map[model.Fingerprint]pushGeneration)
+	var lastErr error
+	for key, g := range groups {
+		mfs := make([]*dto.MetricFamily, 0, len(g.families))
+		for _, mf := range g.families {
+			mfs = append(mfs, mf)
+		}
+		samples, err := extractSamples(mfs)
+		if err != nil {
+			lastErr = fmt.Errorf("group %s: %s", g.labels, err)
+		}
+		if err != nil || len(samples) == 0 {
+			if deleteEmpty {
+				ps.deleteCollected(map[pushGeneration]bool{{key: key, generation: g.generation}: true})
+			}
+			continue
+		}
+		for _, s := range samples {
+			for name, value := range g.labels {
+				s.Metric[name] = value
+			}
+			series[s.Metric.Fingerprint()] = pushGeneration{key: key, generation: g.generation}
+		}
+		stampSamples(samples, now, exposed)
+		vec = append(vec, samples...)
+	}
+	return vec, series, lastErr
+}
+
+// deleteCollected deletes the collected groups, unless they were pushed to since
+func (ps *pushStore) deleteCollected(generations map[pushGeneration]bool) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	for gen := range generations {
+		if g, ok := ps.groups[gen.key]; ok && g.generation == gen.generation {
+			delete(ps.groups, gen.key)
+		}
+	}
+}
+
+// handlePush implements the Pushgateway API: PUT, POST and DELETE on /metrics/job/<JOB>{/<LABEL>/<VALUE>}.
+// Label values (and the job name) may be base64url encoded by suffixing the label name with @base64.
+// The pushed metrics are published on every cycle until deleted, or only on the next one if configured
+func (b *Bridge) handlePush(w http.ResponseWriter, r *http.Request) {
+	labels, err := parseGroupingLabels(strings.TrimPrefix(r.URL.Path, pushPath))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		mfs, err := decodeMetricFamilies(r.Header.Get("Content-Type"), http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkGroupingLabels(mfs, labels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.pushed.put(labels, mfs, r.Method == http.MethodPut)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		b.pushed.delete(labels)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseGroupingLabels parses the grouping labels from a path formatted as job/<JOB>{/<LABEL>/<VALUE>}
+func parseGroupingLabels(path string) (model.LabelSet, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts)%2 != 0 || strings.TrimSuffix(parts[0], "@base64") != string(model.JobLabel) {
+		return nil, fmt.Errorf("grouping labels must be formatted as job/<JOB>{/<LABEL>/<VALUE>}, got %q", path)
+	}
+
+	labels := make(model.LabelSet, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		name, value := parts[i], parts[i+1]
+		if strings.HasSuffix(name, "@base64") {
+			name = strings.TrimSuffix(name, "@base64")
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 encoding for label %q: %s", name, err)
+			}
+			value = string(decoded)
+		}
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		if _, ok := labels[model.LabelName(name)]; ok {
+			return nil, fmt.Errorf("duplicate label %q", name)
+		}
+		labels[model.LabelName(name)] = model.LabelValue(value)
+	}
+
+	if labels[model.JobLabel] == "" {
+		return nil, errors.New("job name is required")
+	}
+	return labels, nil
+}
+
+// checkGroupingLabels rejects pushed metrics whose labels conflict with the grouping labels, like the Pushgateway does
+func checkGroupingLabels(mfs []*dto.MetricFamily, labels model.LabelSet) error {
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			for _, lp := range m.Label {
+				if value, ok := labels[model.LabelName(lp.GetName())]; ok && string(value) != lp.GetValue() {
+					return fmt.Errorf("pushed metric %s has label %s=%q conflicting with the grouping label value %q", mf.GetName(), lp.GetName(), lp.GetValue(), value)
+				}
+			}
+		}
+	}
+	return nil
+}
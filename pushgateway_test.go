@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestPushDeleteAfterPublish(t *testing.T) {
+	cw := newFakeCloudWatch(t)
+	b := newTestBridge(t, &Config{PushReceiver: true, PushDeleteAfterPublish: true}, cw)
+
+	rec := httptest.NewRecorder()
+	b.handlePush(rec, httptest.NewRequest(http.MethodPut, "/metrics/job/backup", strings.NewReader("backup_last_success 1600000000\n")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	// A failed publish keeps the pushed metrics for the next cycle
+	cw.setFailing(true)
+	if _, err := b.PublishOnce(context.Background()); err == nil {
+		t.Fatal("PublishOnce succeeded, want the CloudWatch error")
+	}
+	if len(b.pushed.groups) != 1 {
+		t.Fatalf("%d pushed groups after a failed publish, want the group kept", len(b.pushed.groups))
+	}
+
+	cw.setFailing(false)
+	if _, err := b.PublishOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cw.metricNames(), ","); got != "backup_last_success" {
+		t.Errorf("published %q, want backup_last_success", got)
+	}
+	if len(b.pushed.groups) != 0 {
+		t.Errorf("%d pushed groups after publishing, want the group deleted", len(b.pushed.groups))
+	}
+}
+
+func TestPushStoreKeepsGroupsPushedAgain(t *testing.T) {
+	ps := newPushStore()
+	labels, _ := parseGroupingLabels("job/backup")
+	mfs, _ := decodeMetricFamilies("", strings.NewReader("a 1\n"))
+	ps.put(labels, mfs, true)
+
+	_, series, err := ps.collect(0, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pushed again while the collected metrics are published
+	ps.put(labels, mfs, false)
+
+	collected := make(map[pushGeneration]bool)
+	for _, g := range series {
+		collected[g] = true
+	}
+	ps.deleteCollected(collected)
+	if len(ps.groups) != 1 {
+		t.Errorf("group deleted, want the metrics pushed since the collection kept")
+	}
+}
+
+func TestParseGroupingLabels(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    model.LabelSet
+		wantErr string
+	}{
+		{
+			path: "job/node",
+			want: model.LabelSet{"job": "node"},
+		},
+		{
+			path: "/job/node/instance/web-1/",
+			want: model.LabelSet{"job": "node", "instance": "web-1"},
+		},
+		{
+			// "a/b" and "x=y" base64url encoded, with and without padding
+			path: "job@base64/YS9i/path@base64/eD15",
+			want: model.LabelSet{"job": "a/b", "path": "x=y"},
+		},
+		{
+			path: "job/node/instance@base64/aG9zdA==",
+			want: model.LabelSet{"job": "node", "instance": "host"},
+		},
+		{
+			// A single `=` is the base64 encoding of an empty value
+			path: "job/node/instance@base64/=",
+			want: model.LabelSet{"job": "node", "instance": ""},
+		},
+		{
+			path:    "job@base64/=",
+			wantErr: "job name is required",
+		},
+		{
+			path:    "job/node/instance@base64/!!",
+			wantErr: `invalid base64 encoding for label "instance"`,
+		},
+		{
+			path:    "job/node/instance/a/instance/b",
+			wantErr: `duplicate label "instance"`,
+		},
+		{
+			path:    "job/node/instance@base64/YQ/instance/a",
+			wantErr: `duplicate label "instance"`,
+		},
+		{
+			path:    "job/node/__name__/up",
+			wantErr: `invalid label name "__name__"`,
+		},
+		{
+			path:    "job/node/1st/a",
+			wantErr: `invalid label name "1st"`,
+		},
+		{
+			path:    "job/node/instance",
+			wantErr: "grouping labels must be formatted as job/<JOB>{/<LABEL>/<VALUE>}",
+		},
+		{
+			path:    "instance/web-1",
+			wantErr: "grouping labels must be formatted as job/<JOB>{/<LABEL>/<VALUE>}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := parseGroupingLabels(tt.path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckGroupingLabels(t *testing.T) {
+	labels := model.LabelSet{"job": "node", "instance": "web-1"}
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{
+			name:  "without grouping labels",
+			input: "up 1\n# EOF\n",
+		},
+		{
+			name:  "with the grouping label values",
+			input: "up{job=\"node\",instance=\"web-1\",zone=\"a\"} 1\n# EOF\n",
+		},
+		{
+			name:    "conflicting label value",
+			input:   "up 1\nrequests_total{instance=\"web-2\"} 1\n# EOF\n",
+			wantErr: `pushed metric requests_total has label instance="web-2" conflicting with the grouping label value "web-1"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mfs, err := parseOpenMetrics(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkGroupingLabels(mfs, labels)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("error = %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// maxRequestBodySize is the largest request body accepted by the push receivers (after decompression),
+// so that a misbehaving client can't exhaust the memory of the bridge
+const maxRequestBodySize = 32 << 20
+
+// sampleBuffer holds the latest sample of each series pushed to the bridge between two publish cycles
+type sampleBuffer struct {
+	mtx     sync.Mutex
+	samples map[model.Fingerprint]*model.Sample
+}
+
+func newSampleBuffer() *sampleBuffer {
+	return &sampleBuffer{samples: make(map[model.Fingerprint]*model.Sample)}
+}
+
+// add stores the sample, unless a more recent sample of the same series is already buffered
+func (sb *sampleBuffer) add(s *model.Sample) {
+	fp := s.Metric.Fingerprint()
+
+	sb.mtx.Lock()
+	defer sb.mtx.Unlock()
+
+	if prev, ok := sb.samples[fp]; ok && prev.Timestamp.After(s.Timestamp) {
+		return
+	}
+	sb.samples[fp] = s
+}
+
+// addDelta adds the value of the sample to the buffered sample of the same series, for samples holding the change
+// since the previous sample (e.g. OTLP delta sums). The most recent timestamp is kept
+func (sb *sampleBuffer) addDelta(s *model.Sample) {
+	fp := s.Metric.Fingerprint()
+
+	sb.mtx.Lock()
+	defer sb.mtx.Unlock()
+
+	prev, ok := sb.samples[fp]
+	if !ok {
+		sb.samples[fp] = s
+		return
+	}
+	sum := &model.Sample{Metric: prev.Metric, Value: prev.Value + s.Value, Timestamp: prev.Timestamp}
+	if s.Timestamp.After(sum.Timestamp) {
+		sum.Timestamp = s.Timestamp
+	}
+	sb.samples[fp] = sum
+}
+
+// drain returns the buffered samples and empties the buffer
+func (sb *sampleBuffer) drain() model.Vector {
+	sb.mtx.Lock()
+	defer sb.mtx.Unlock()
+
+	vec := make(model.Vector, 0, len(sb.samples))
+	for _, s := range sb.samples {
+		vec = append(vec, s)
+	}
+	sb.samples = make(map[model.Fingerprint]*model.Sample)
+	return vec
+}
+
+// receive buffers a sample received by a push receiver until the next publish cycle. Received samples carry the
+// timestamp sent by their source.
+// With statistic sets, all the samples received during the interval are aggregated instead of only keeping the latest
+func (b *Bridge) receive(s *model.Sample) {
+	if b.statisticSets {
+		b.aggregated.add(model.Vector{s}, timestampedSeries{s.Metric.Fingerprint(): true})
+		return
+	}
+	b.received.add(s)
+}
+
+// receiveDelta buffers a sample holding the change since the previous sample of the series, adding it to the samples
+// of the series already received during the interval. With statistic sets, each change is aggregated as a sample,
+// and the Sum statistic holds the total
+func (b *Bridge) receiveDelta(s *model.Sample) {
+	if b.statisticSets {
+		b.aggregated.add(model.Vector{s}, timestampedSeries{s.Metric.Fingerprint(): true})
+		return
+	}
+	b.received.addDelta(s)
+}
+
+// handle registers the handler of a push receiver, creating the HTTP server mux if needed
+func (b *Bridge) handle(pattern string, handler http.HandlerFunc) {
+	if b.mux == nil {
+		b.mux = http.NewServeMux()
+	}
+	b.mux.HandleFunc(pattern, handler)
+}
+
+// serve runs the HTTP server of the push receivers until the context is done
+func (b *Bridge) serve(ctx context.Context) {
+	server := &http.Server{Addr: b.listenAddress, Handler: b.mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Println("prometheus-to-cloudwatch: error stopping HTTP server:", err)
+		}
+	}()
+
+	log.Printf("prometheus-to-cloudwatch: listening on %s", b.listenAddress)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal("prometheus-to-cloudwatch: Error: ", err)
+	}
+}
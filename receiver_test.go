@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestReceiveStatisticSets(t *testing.T) {
+	cw := newFakeCloudWatch(t)
+
+	b := newTestBridge(t, &Config{RemoteWriteReceiver: true, StatisticSets: true}, cw)
+	now := model.Now()
+	latency := model.Metric{"__name__": "request_latency_seconds"}
+	for i, v := range []model.SampleValue{0.25, 0.5, 0.125} {
+		b.receive(&model.Sample{Metric: latency, Value: v, Timestamp: now.Add(time.Duration(i-3) * time.Second)})
+	}
+	// Each change of a delta series is a sample, whose sum is the total
+	requests := model.Metric{"__name__": "requests"}
+	for i, v := range []model.SampleValue{3, 4} {
+		b.receiveDelta(&model.Sample{Metric: requests, Value: v, Timestamp: now.Add(time.Duration(i-3) * time.Second)})
+	}
+	// Published as a statistic set even when received once
+	b.receive(&model.Sample{Metric: model.Metric{"__name__": "up"}, Value: 1, Timestamp: now})
+
+	if _, err := b.publishCollected(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]string{
+		"request_latency_seconds": {"SampleCount": "3", "Sum": "0.875", "Minimum": "0.125", "Maximum": "0.5"},
+		"requests":                {"SampleCount": "2", "Sum": "7", "Minimum": "3", "Maximum": "4"},
+		"up":                      {"SampleCount": "1", "Sum": "1", "Minimum": "1", "Maximum": "1"},
+	}
+	got := make(map[string]map[string]string)
+	for _, form := range cw.requests {
+		for i := 1; form.Get(fmt.Sprintf("MetricData.member.%d.MetricName", i)) != ""; i++ {
+			prefix := fmt.Sprintf("MetricData.member.%d.", i)
+			if v := form.Get(prefix + "Value"); v != "" {
+				t.Errorf("%s published with value %s, want statistic values", form.Get(prefix+"MetricName"), v)
+			}
+			stats := make(map[string]string)
+			for _, s := range []string{"SampleCount", "Sum", "Minimum", "Maximum"} {
+				stats[s] = form.Get(prefix + "StatisticValues." + s)
+			}
+			got[form.Get(prefix+"MetricName")] = stats
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("published statistic values %v, want %v", got, want)
+	}
+}
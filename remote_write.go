@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWritePath is the path of the Prometheus remote-write receiver
+const remoteWritePath = "/api/v1/write"
+
+// handleRemoteWrite accepts snappy-compressed Prometheus remote-write requests.
+// The received samples are buffered and published on the next cycle
+func (b *Bridge) handleRemoteWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if n, err := snappy.DecodedLen(compressed); err == nil && n > maxRequestBodySize {
+		http.Error(w, fmt.Sprintf("decompressed request larger than %d bytes", maxRequestBodySize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("decompressing request failed: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	samples, err := decodeWriteRequest(buf)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("decoding request failed: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	for _, s := range samples {
+		if b.shouldIgnoreMetric(getName(s.Metric)) {
+			continue
+		}
+		b.receive(s)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeWriteRequest decodes a prometheus.WriteRequest protobuf message into samples:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; ... }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; ... }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+//
+// Metadata and fields of newer protocol versions (e.g. exemplars, histograms) are skipped
+func decodeWriteRequest(buf []byte) (model.Vector, error) {
+	var vec model.Vector
+	err := decodeMessage(buf, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		samples, err := decodeTimeSeries(value)
+		if err != nil {
+			return err
+		}
+		vec = append(vec, samples...)
+		return nil
+	})
+	return vec, err
+}
+
+func decodeTimeSeries(buf []byte) (model.Vector, error) {
+	metric := model.Metric{}
+	var vec model.Vector
+	err := decodeMessage(buf, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			var name, val string
+			if err := decodeMessage(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				if typ == protowire.BytesType && num == 1 {
+					name = string(value)
+				} else if typ == protowire.BytesType && num == 2 {
+					val = string(value)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			metric[model.LabelName(name)] = model.LabelValue(val)
+		case 2:
+			s := &model.Sample{Metric: metric}
+			if err := decodeMessage(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				if typ == protowire.Fixed64Type && num == 1 {
+					v, _ := protowire.ConsumeFixed64(value)
+					s.Value = model.SampleValue(math.Float64frombits(v))
+				} else if typ == protowire.VarintType && num == 2 {
+					v, _ := protowire.ConsumeVarint(value)
+					s.Timestamp = model.Time(int64(v))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			vec = append(vec, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Series without a metric name can't be published
+	if _, ok := metric[model.MetricNameLabel]; !ok {
+		return nil, nil
+	}
+	return vec, nil
+}
+
+// decodeMessage calls fn for each field of the protobuf message in buf.
+// For length-delimited fields, value is the content of the field, otherwise the raw encoded value
+func decodeMessage(buf []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+
+		var value []byte
+		if typ == protowire.BytesType {
+			v, m := protowire.ConsumeBytes(buf)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			value, n = v, m
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value = buf[:n]
+		}
+		if err := fn(num, typ, value); err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pbMessage encodes a length-delimited field holding the concatenated fields
+func pbMessage(num protowire.Number, fields ...[]byte) []byte {
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendBytes(b, bytes.Join(fields, nil))
+}
+
+func pbString(num protowire.Number, s string) []byte {
+	return pbMessage(num, []byte(s))
+}
+
+func pbVarint(num protowire.Number, v uint64) []byte {
+	b := protowire.AppendTag(nil, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func pbDouble(num protowire.Number, v float64) []byte {
+	b := protowire.AppendTag(nil, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+func pbFixed32(num protowire.Number, v uint32) []byte {
+	b := protowire.AppendTag(nil, num, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, v)
+}
+
+func rwLabel(name, value string) []byte {
+	return pbMessage(1, pbString(1, name), pbString(2, value))
+}
+
+func rwSample(value float64, ts int64) []byte {
+	return pbMessage(2, pbDouble(1, value), pbVarint(2, uint64(ts)))
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	golden, _ := hex.DecodeString("0a2f0a0e0a085f5f6e616d655f5f120275700a0b0a036a6f6212046e6f6465121009000000000000f03f108080babbc82e")
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "golden",
+			input: golden,
+			want:  []string{`up{job="node"} => 1 @[1600000000]`},
+		},
+		{
+			name: "several series and samples",
+			input: bytes.Join([][]byte{
+				pbMessage(1, rwLabel("__name__", "http_requests_total"), rwLabel("code", "200"), rwSample(3, 1000), rwSample(5, 2000)),
+				pbMessage(1, rwLabel("__name__", "up"), rwSample(0, 3000)),
+			}, nil),
+			want: []string{
+				`http_requests_total{code="200"} => 3 @[1]`,
+				`http_requests_total{code="200"} => 5 @[2]`,
+				`up => 0 @[3]`,
+			},
+		},
+		{
+			name:  "labels after samples",
+			input: pbMessage(1, rwSample(1, 1000), rwLabel("__name__", "up")),
+			want:  []string{`up => 1 @[1]`},
+		},
+		{
+			name: "exemplars, histograms and metadata skipped",
+			input: bytes.Join([][]byte{
+				pbMessage(1,
+					rwLabel("__name__", "up"),
+					rwSample(1, 1000),
+					pbMessage(3, rwLabel("trace_id", "abc"), pbDouble(2, 1), pbVarint(3, 1000)),
+					pbMessage(4, pbVarint(1, 1)),
+				),
+				pbMessage(3, pbVarint(1, 1), pbString(2, "up")),
+				pbFixed32(5, 1),
+			}, nil),
+			want: []string{`up => 1 @[1]`},
+		},
+		{
+			name:  "series without a name dropped",
+			input: pbMessage(1, rwLabel("job", "node"), rwSample(1, 1000)),
+			want:  []string{},
+		},
+		{
+			name:    "truncated message",
+			input:   golden[:len(golden)-3],
+			wantErr: true,
+		},
+		{
+			name:    "invalid tag",
+			input:   []byte{0x0f},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vec, err := decodeWriteRequest(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decoded %v, want an error", vec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(vec))
+			for _, s := range vec {
+				got = append(got, s.String())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestHandleRemoteWrite(t *testing.T) {
+	b := &Bridge{received: newSampleBuffer()}
+	body := snappy.Encode(nil, pbMessage(1, rwLabel("__name__", "up"), rwSample(1, 1000)))
+
+	rec := httptest.NewRecorder()
+	b.handleRemoteWrite(rec, httptest.NewRequest(http.MethodPost, remoteWritePath, bytes.NewReader(body)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204: %s", rec.Code, rec.Body)
+	}
+	if got := b.received.drain(); len(got) != 1 || got[0].String() != `up => 1 @[1]` {
+		t.Errorf("received %v, want the sample", got)
+	}
+
+	rec = httptest.NewRecorder()
+	b.handleRemoteWrite(rec, httptest.NewRequest(http.MethodPost, remoteWritePath, strings.NewReader("not snappy")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d for an invalid body, want 400", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	b.handleRemoteWrite(rec, httptest.NewRequest(http.MethodPost, remoteWritePath, bytes.NewReader(make([]byte, maxRequestBodySize+1))))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d for an oversized body, want 400", rec.Code)
+	}
+}
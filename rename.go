@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/prometheus/common/model"
+)
+
+// RenameRule renames the metrics whose whole name matches Regex. The Replacement is a template evaluated for each sample
+// (see renameTemplateData), whose result may reference the capture groups of Regex with $1 or ${name}
+type RenameRule struct {
+	Regex       *regexp.Regexp
+	Replacement *template.Template
+}
+
+// renameTemplateData is the data passed to the RenameRule replacement templates
+type renameTemplateData struct {
+	// Name of the metric in Prometheus
+	Name string
+
+	// Labels of the sample being published
+	Labels map[string]string
+}
+
+// NewRenameRule compiles the regular expression and parses the replacement template, and returns a RenameRule,
+// or an error if either is invalid
+func NewRenameRule(regex, replacement string) (RenameRule, error) {
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return RenameRule{}, err
+	}
+	tmpl, err := template.New(regex).Funcs(DimensionTemplateFuncs).Option("missingkey=zero").Parse(replacement)
+	if err != nil {
+		return RenameRule{}, err
+	}
+	return RenameRule{Regex: re, Replacement: tmpl}, nil
+}
+
+// getMetricName returns the name the metric is published under in CloudWatch: the result of the first matching
+// rename rule, or the Prometheus name without the configured prefixes and suffixes, converted to PascalCase if configured.
+// When the matching rule fails, the failure is logged and the name falls back to the one without a rule.
+// Filters and rules (e.g. include_metrics or namespace_rules) always match the Prometheus name
+func (b *Bridge) getMetricName(name string, m model.Metric) string {
+	renamed := ""
+	for _, rule := range b.renameRules {
+		if rule.Regex.MatchString(name) {
+			var err error
+			if renamed, err = rule.rename(name, m); err != nil {
+				log.Printf("prometheus-to-cloudwatch: error renaming metric %q with rule %q: %s", name, rule.Regex, err)
+			}
+			break
+		}
+	}
+
+	if renamed == "" {
+		renamed = name
+		for _, prefix := range b.stripPrefixes {
+			if strings.HasPrefix(renamed, prefix) && len(renamed) > len(prefix) {
+				renamed = strings.TrimPrefix(renamed, prefix)
+				break
+			}
+		}
+		for _, suffix := range b.stripSuffixes {
+			if strings.HasSuffix(renamed, suffix) && len(renamed) > len(suffix) {
+				renamed = strings.TrimSuffix(renamed, suffix)
+				break
+			}
+		}
+	}
+
+	if b.pascalCaseNames {
+		renamed = toPascalCase(renamed)
+	}
+	return renamed
+}
+
+// rename evaluates the replacement template and expands the capture groups. It returns an error if the template fails
+// or the result is empty
+func (rule RenameRule) rename(name string, m model.Metric) (string, error) {
+	data := renameTemplateData{
+		Name:   name,
+		Labels: make(map[string]string, len(m)),
+	}
+	for k, v := range m {
+		// Label values are inserted literally, not as references to capture groups
+		data.Labels[string(k)] = strings.Replace(string(v), "$", "$$", -1)
+	}
+
+	var sb strings.Builder
+	if err := rule.Replacement.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	renamed := rule.Regex.ReplaceAllString(name, sb.String())
+	if renamed == "" {
+		return "", errors.New("the replacement is empty")
+	}
+	return renamed, nil
+}
+
+// toPascalCase converts a snake_case name (or one with colons, as in recording rules) to PascalCase
+func toPascalCase(name string) string {
+	var sb strings.Builder
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == ':' }) {
+		r, size := utf8.DecodeRuneInString(part)
+		sb.WriteRune(unicode.ToUpper(r))
+		sb.WriteString(part[size:])
+	}
+	if sb.Len() == 0 {
+		return name
+	}
+	return sb.String()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestGetMetricName(t *testing.T) {
+	mustRule := func(regex, replacement string) RenameRule {
+		rule, err := NewRenameRule(regex, replacement)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rule
+	}
+
+	tests := []struct {
+		name       string
+		rule       RenameRule
+		metric     model.Metric
+		pascalCase bool
+		want       string
+	}{
+		{
+			name:   "no matching rule",
+			rule:   mustRule("http_.*", "requests"),
+			metric: model.Metric{"__name__": "node_memory_bytes"},
+			want:   "memory_bytes",
+		},
+		{
+			name:   "regex matches the whole name",
+			rule:   mustRule("memory", "mem"),
+			metric: model.Metric{"__name__": "node_memory_bytes"},
+			want:   "memory_bytes",
+		},
+		{
+			name:   "numbered capture group",
+			rule:   mustRule("node_(.*)_bytes", "Node_${1}"),
+			metric: model.Metric{"__name__": "node_memory_bytes"},
+			want:   "Node_memory",
+		},
+		{
+			name:   "named capture group",
+			rule:   mustRule("(?P<what>.*)_total", "${what}_count"),
+			metric: model.Metric{"__name__": "http_requests_total"},
+			want:   "http_requests_count",
+		},
+		{
+			name:   "label template",
+			rule:   mustRule("http_requests_total", "{{.Labels.code}}_responses"),
+			metric: model.Metric{"__name__": "http_requests_total", "code": "200"},
+			want:   "200_responses",
+		},
+		{
+			name:   "label values are not expanded",
+			rule:   mustRule("(build)_info", "${1}_{{.Labels.version}}"),
+			metric: model.Metric{"__name__": "build_info", "version": "$1"},
+			want:   "build_$1",
+		},
+		{
+			name:   "failing template falls back",
+			rule:   mustRule("node_.*", "{{.Missing}}"),
+			metric: model.Metric{"__name__": "node_memory_bytes"},
+			want:   "memory_bytes",
+		},
+		{
+			name:   "empty replacement falls back",
+			rule:   mustRule("node_.*", "{{.Labels.missing}}"),
+			metric: model.Metric{"__name__": "node_memory_bytes"},
+			want:   "memory_bytes",
+		},
+		{
+			name:       "PascalCase",
+			rule:       mustRule("node_(.*)", "host_${1}"),
+			metric:     model.Metric{"__name__": "node_memory_bytes"},
+			pascalCase: true,
+			want:       "HostMemoryBytes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Bridge{renameRules: []RenameRule{tt.rule}, stripPrefixes: []string{"node_"}, pascalCaseNames: tt.pascalCase}
+			if got := b.getMetricName(getName(tt.metric), tt.metric); got != tt.want {
+				t.Errorf("getMetricName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToPascalCase(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"node_cpu_seconds_total", "NodeCpuSecondsTotal"},
+		{"job:http_requests:rate5m", "JobHttpRequestsRate5m"},
+		{"_leading__and_trailing_", "LeadingAndTrailing"},
+		{"Up", "Up"},
+		{"état_queue", "ÉtatQueue"},
+		{"queue_ärger_ñ", "QueueÄrgerÑ"},
+		{"__", "__"},
+	}
+	for _, tt := range tests {
+		if got := toPascalCase(tt.in); got != tt.want {
+			t.Errorf("toPascalCase(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
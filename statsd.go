@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+// statsdTimer accumulates the timer (or histogram/distribution) observations of a series during a flush interval
+type statsdTimer struct {
+	metric model.Metric
+	unit   string
+	count  float64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+// statsdSet accumulates the unique values of a set during a flush interval
+type statsdSet struct {
+	metric model.Metric
+	values map[string]bool
+}
+
+// statsdAggregator aggregates StatsD (and DogStatsD) metrics per flush interval:
+// counters are summed (and reset on flush), gauges keep their last value across flushes,
+// timers are published as `_count`, `_sum`, `_min` and `_max` series and sets as their number of unique values
+type statsdAggregator struct {
+	mtx      sync.Mutex
+	counters map[model.Fingerprint]*model.Sample
+	gauges   map[model.Fingerprint]*model.Sample
+	timers   map[model.Fingerprint]*statsdTimer
+	sets     map[model.Fingerprint]*statsdSet
+}
+
+func newStatsdAggregator() *statsdAggregator {
+	return &statsdAggregator{
+		counters: make(map[model.Fingerprint]*model.Sample),
+		gauges:   make(map[model.Fingerprint]*model.Sample),
+		timers:   make(map[model.Fingerprint]*statsdTimer),
+		sets:     make(map[model.Fingerprint]*statsdSet),
+	}
+}
+
+// listenStatsd receives StatsD packets on the UDP address until the context is done
+func (b *Bridge) listenStatsd(ctx context.Context) {
+	conn, err := net.ListenPacket("udp", b.statsdListenAddress)
+	if err != nil {
+		log.Fatal("prometheus-to-cloudwatch: Error: ", err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	log.Printf("prometheus-to-cloudwatch: listening for StatsD on %s", b.statsdListenAddress)
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("prometheus-to-cloudwatch: error reading StatsD packet:", err)
+			continue
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if err := b.statsd.processLine(line); err != nil {
+				log.Printf("prometheus-to-cloudwatch: error parsing StatsD line %q: %s", line, err)
+			}
+		}
+	}
+}
+
+// processLine parses a line formatted as <name>:<value>[:<value>...]|<type>[|@<sample rate>][|#<tag>:<value>,...]
+// and aggregates its values. DogStatsD events and service checks are ignored
+func (a *statsdAggregator) processLine(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+		return nil
+	}
+
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 {
+		return errors.New("missing metric type")
+	}
+	nameAndValues := strings.Split(parts[0], ":")
+	if len(nameAndValues) < 2 {
+		return errors.New("missing metric value")
+	}
+
+	name := sanitizeMetricName(nameAndValues[0])
+	if name == "" {
+		return errors.New("missing metric name")
+	}
+	metric := model.Metric{model.MetricNameLabel: model.LabelValue(name)}
+	typ := parts[1]
+	sampleRate := 1.0
+
+	for _, field := range parts[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return fmt.Errorf("invalid sample rate %q", field[1:])
+			}
+			sampleRate = rate
+		case strings.HasPrefix(field, "#"):
+			for _, tag := range strings.Split(field[1:], ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				labelName := sanitizeLabelName(kv[0])
+				if labelName == "" || labelName == model.MetricNameLabel {
+					continue
+				}
+				// Tags without a value can't be published as dimensions
+				if len(kv) == 2 {
+					metric[labelName] = model.LabelValue(kv[1])
+				}
+			}
+		}
+	}
+
+	fp := metric.Fingerprint()
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	for _, raw := range nameAndValues[1:] {
+		if typ == "s" {
+			set, ok := a.sets[fp]
+			if !ok {
+				set = &statsdSet{metric: metric, values: make(map[string]bool)}
+				a.sets[fp] = set
+			}
+			set.values[raw] = true
+			continue
+		}
+
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value %q", raw)
+		}
+
+		switch typ {
+		case "c":
+			counter, ok := a.counters[fp]
+			if !ok {
+				counter = &model.Sample{Metric: metric}
+				a.counters[fp] = counter
+			}
+			counter.Value += model.SampleValue(value / sampleRate)
+		case "g":
+			gauge, ok := a.gauges[fp]
+			if !ok {
+				gauge = &model.Sample{Metric: metric}
+				a.gauges[fp] = gauge
+			}
+			// A signed value modifies the current value of the gauge
+			if strings.HasPrefix(raw, "+") || strings.HasPrefix(raw, "-") {
+				gauge.Value += model.SampleValue(value)
+			} else {
+				gauge.Value = model.SampleValue(value)
+			}
+		case "ms", "h", "d":
+			timer, ok := a.timers[fp]
+			if !ok {
+				timer = &statsdTimer{metric: metric, min: math.Inf(1), max: math.Inf(-1)}
+				if typ == "ms" {
+					timer.unit = "Milliseconds"
+				}
+				a.timers[fp] = timer
+			}
+			timer.count += 1 / sampleRate
+			timer.sum += value / sampleRate
+			timer.min = math.Min(timer.min, value)
+			timer.max = math.Max(timer.max, value)
+		default:
+			return fmt.Errorf("unsupported metric type %q", typ)
+		}
+	}
+	return nil
+}
+
+// flush returns the samples aggregated since the previous flush, and resets counters, timers and sets
+func (a *statsdAggregator) flush(now model.Time) model.Vector {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	vec := make(model.Vector, 0, len(a.counters)+len(a.gauges)+4*len(a.timers)+len(a.sets))
+	add := func(metric model.Metric, suffix, unit string, value float64) {
+		m := metric.Clone()
+		if suffix != "" {
+			m[model.MetricNameLabel] += model.LabelValue(suffix)
+		}
+		if unit != "" {
+			m[cwUnitLabel] = model.LabelValue(unit)
+		}
+		vec = append(vec, &model.Sample{Metric: m, Value: model.SampleValue(value), Timestamp: now})
+	}
+
+	for _, counter := range a.counters {
+		add(counter.Metric, "", "Count", float64(counter.Value))
+	}
+	for _, gauge := range a.gauges {
+		add(gauge.Metric, "", "", float64(gauge.Value))
+	}
+	for _, timer := range a.timers {
+		add(timer.metric, "_count", "Count", timer.count)
+		add(timer.metric, "_sum", timer.unit, timer.sum)
+		add(timer.metric, "_min", timer.unit, timer.min)
+		add(timer.metric, "_max", timer.unit, timer.max)
+	}
+	for _, set := range a.sets {
+		add(set.metric, "", "Count", float64(len(set.values)))
+	}
+
+	a.counters = make(map[model.Fingerprint]*model.Sample)
+	a.timers = make(map[model.Fingerprint]*statsdTimer)
+	a.sets = make(map[model.Fingerprint]*statsdSet)
+	return vec
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStatsdAggregator(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		want     []string
+		wantNext []string
+		wantErr  string
+	}{
+		{
+			name:  "counter with sample rate is reset on flush",
+			lines: []string{"requests:1|c|@0.5", "requests:3|c"},
+			want:  []string{`requests{__cw_unit="Count"} => 5 @[1]`},
+		},
+		{
+			name:     "signed gauge deltas and carry-over",
+			lines:    []string{"temperature:10|g", "temperature:+5|g", "temperature:-3|g"},
+			want:     []string{`temperature => 12 @[1]`},
+			wantNext: []string{`temperature => 12 @[2]`},
+		},
+		{
+			name:  "multi-value timer",
+			lines: []string{"latency:10:30:20|ms"},
+			want: []string{
+				`latency_count{__cw_unit="Count"} => 3 @[1]`,
+				`latency_max{__cw_unit="Milliseconds"} => 30 @[1]`,
+				`latency_min{__cw_unit="Milliseconds"} => 10 @[1]`,
+				`latency_sum{__cw_unit="Milliseconds"} => 60 @[1]`,
+			},
+		},
+		{
+			name:  "histogram with sample rate",
+			lines: []string{"size:4|h|@0.5"},
+			want: []string{
+				`size_count{__cw_unit="Count"} => 2 @[1]`,
+				`size_max => 4 @[1]`,
+				`size_min => 4 @[1]`,
+				`size_sum => 8 @[1]`,
+			},
+		},
+		{
+			name:  "set",
+			lines: []string{"users:alice|s", "users:bob|s", "users:alice|s"},
+			want:  []string{`users{__cw_unit="Count"} => 2 @[1]`},
+		},
+		{
+			name:  "DogStatsD tags",
+			lines: []string{"page.views:1|c|#env:prod,region:us-east-1,canary,__name__:other"},
+			want:  []string{`page_views{__cw_unit="Count", env="prod", region="us-east-1"} => 1 @[1]`},
+		},
+		{
+			name:  "events and service checks skipped",
+			lines: []string{"_e{5,4}:title|text|#env:prod", "_sc|check|0", ""},
+		},
+		{
+			name:    "missing type",
+			lines:   []string{"requests:1"},
+			wantErr: "missing metric type",
+		},
+		{
+			name:    "missing value",
+			lines:   []string{"requests|c"},
+			wantErr: "missing metric value",
+		},
+		{
+			name:    "invalid sample rate",
+			lines:   []string{"requests:1|c|@2"},
+			wantErr: `invalid sample rate "2"`,
+		},
+		{
+			name:    "invalid value",
+			lines:   []string{"requests:one|c"},
+			wantErr: `invalid value "one"`,
+		},
+		{
+			name:    "unsupported type",
+			lines:   []string{"requests:1|x"},
+			wantErr: `unsupported metric type "x"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newStatsdAggregator()
+			for _, line := range tt.lines {
+				err := a.processLine(line)
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("error = %v, want %q", err, tt.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := formatSamples(a.flush(1000)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			// Counters, timers and sets are reset on flush, gauges keep their value
+			if got := formatSamples(a.flush(2000)); !reflect.DeepEqual(got, tt.wantNext) {
+				t.Errorf("got after the next flush\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.wantNext, "\n"))
+			}
+		})
+	}
+}
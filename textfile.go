@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// textfileLabel is the label holding the name of the file the metrics were read from
+const textfileLabel = "file"
+
+// readTextfiles reads the metrics from the *.prom files in the textfile directory, like the node_exporter textfile collector.
+// Files that are being written (not ending with a newline) or can't be parsed are skipped until the next cycle.
+// The series of the samples written with a timestamp are added to `exposed`
+func (b *Bridge) readTextfiles(now model.Time, exposed timestampedSeries) model.Vector {
+	paths, err := filepath.Glob(filepath.Join(b.textfileDirectory, "*.prom"))
+	if err != nil {
+		log.Println("prometheus-to-cloudwatch: error listing textfile directory:", err)
+		return nil
+	}
+
+	var vec model.Vector
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("prometheus-to-cloudwatch: error reading textfile %q: %s", path, err)
+			continue
+		}
+		if len(content) == 0 || content[len(content)-1] != '\n' {
+			log.Printf("prometheus-to-cloudwatch: skipping partially written textfile %q", path)
+			continue
+		}
+
+		var mfs []*dto.MetricFamily
+		if mfs, err = decodeMetricFamilies(string(expfmt.FmtText), bytes.NewReader(content)); err != nil {
+			log.Printf("prometheus-to-cloudwatch: error parsing textfile %q: %s", path, err)
+			continue
+		}
+		samples, err := extractSamples(mfs)
+		if err != nil {
+			log.Printf("prometheus-to-cloudwatch: error decoding textfile %q: %s", path, err)
+			continue
+		}
+
+		file := model.LabelValue(filepath.Base(path))
+		for _, s := range samples {
+			s.Metric[textfileLabel] = file
+		}
+		stampSamples(samples, now, exposed)
+		vec = append(vec, samples...)
+	}
+	return vec
+}
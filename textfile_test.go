@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReadTextfiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"backup.prom":  "# TYPE backup_last_success_seconds gauge\nbackup_last_success_seconds 1600000000\n",
+		"raid.prom":    "node_md_disks{device=\"md0\"} 2\n",
+		"cron.prom":    "cron_last_run_seconds 1600000000 1599999990000\n",
+		"partial.prom": "writing_in_progress 1\nwriting_in",
+		"empty.prom":   "",
+		"invalid.prom": "invalid{ 1\n",
+		"ignored.txt":  "not_a_textfile 1\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := &Bridge{textfileDirectory: dir}
+	exposed := make(timestampedSeries)
+	var got, gotExposed []string
+	for _, s := range b.readTextfiles(1600000000000, exposed) {
+		got = append(got, s.String())
+		if exposed[s.Metric.Fingerprint()] {
+			gotExposed = append(gotExposed, s.Metric.String())
+		}
+	}
+	sort.Strings(got)
+
+	want := []string{
+		`backup_last_success_seconds{file="backup.prom"} => 1600000000 @[1600000000]`,
+		`cron_last_run_seconds{file="cron.prom"} => 1600000000 @[1599999990]`,
+		`node_md_disks{device="md0", file="raid.prom"} => 2 @[1600000000]`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("read %v, want %v", got, want)
+	}
+	// Only the samples written with a timestamp keep it, once the file label is added
+	if want := []string{`cron_last_run_seconds{file="cron.prom"}`}; strings.Join(gotExposed, "\n") != strings.Join(want, "\n") || len(exposed) != 1 {
+		t.Errorf("exposed timestamps %v, want %v", gotExposed, want)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/gobwas/glob"
+	"github.com/prometheus/common/model"
+)
+
+// cloudWatchUnits is the set of units accepted by CloudWatch
+var cloudWatchUnits = stringSliceToSet(cloudwatch.StandardUnit_Values())
+
+// UnitOverride sets the unit of the metrics matching a Glob, regardless of their labels and names
+type UnitOverride struct {
+	Matcher glob.Glob
+	Unit    string
+}
+
+// NewUnitOverride returns a UnitOverride, or an error if the unit is not accepted by CloudWatch
+func NewUnitOverride(pattern, unit string) (UnitOverride, error) {
+	if !cloudWatchUnits[unit] {
+		return UnitOverride{}, fmt.Errorf("invalid CloudWatch unit %q", unit)
+	}
+	matcher, err := glob.Compile(pattern)
+	if err != nil {
+		return UnitOverride{}, err
+	}
+	return UnitOverride{Matcher: matcher, Unit: unit}, nil
+}
+
+// UnitConversion multiplies the values of the metrics matching a Glob by a factor and sets their unit,
+// e.g. to publish `*_seconds` metrics in Milliseconds with a factor of 1000
+type UnitConversion struct {
+	Matcher glob.Glob
+	Unit    string
+	Factor  float64
+}
+
+// NewUnitConversion returns a UnitConversion, or an error if the unit is not accepted by CloudWatch or the factor is invalid
+func NewUnitConversion(pattern, unit string, factor float64) (UnitConversion, error) {
+	if !cloudWatchUnits[unit] {
+		return UnitConversion{}, fmt.Errorf("invalid CloudWatch unit %q", unit)
+	}
+	if factor == 0 || math.IsInf(factor, 0) || math.IsNaN(factor) {
+		return UnitConversion{}, errors.New("conversion factor must be a finite number other than 0")
+	}
+	matcher, err := glob.Compile(pattern)
+	if err != nil {
+		return UnitConversion{}, err
+	}
+	return UnitConversion{Matcher: matcher, Unit: unit, Factor: factor}, nil
+}
+
+// ParseUnitConversion returns the UnitConversion of a spec formatted as UNIT*FACTOR or UNIT/DIVISOR, or UNIT alone
+// for a factor of 1, or an error if the conversion is invalid
+func ParseUnitConversion(pattern, spec string) (UnitConversion, error) {
+	// Units may contain a slash (e.g. Bytes/Second), only a trailing number is a factor or divisor
+	unit, factor := spec, 1.0
+	if i := strings.LastIndexAny(spec, "*/"); i >= 0 {
+		if f, err := strconv.ParseFloat(spec[i+1:], 64); err == nil {
+			unit, factor = spec[:i], f
+			if spec[i] == '/' {
+				factor = 1 / f
+			}
+		}
+	}
+	return NewUnitConversion(pattern, unit, factor)
+}
+
+// unitSuffix maps a metric name suffix following the Prometheus naming conventions to a CloudWatch unit,
+// and the factor converting the values to that unit
+type unitSuffix struct {
+	suffix string
+	unit   string
+	scale  float64
+}
+
+var unitSuffixes = []unitSuffix{
+	{"_seconds", cloudwatch.StandardUnitSeconds, 1},
+	{"_milliseconds", cloudwatch.StandardUnitMilliseconds, 1},
+	{"_microseconds", cloudwatch.StandardUnitMicroseconds, 1},
+	{"_bytes", cloudwatch.StandardUnitBytes, 1},
+	{"_bits", cloudwatch.StandardUnitBits, 1},
+	{"_percent", cloudwatch.StandardUnitPercent, 1},
+	// Ratios are between 0 and 1, CloudWatch percents between 0 and 100
+	{"_ratio", cloudwatch.StandardUnitPercent, 100},
+}
+
+// inferUnit returns the unit implied by the metric name and the factor converting the values to it.
+// Counters (`_total`) of a unit keep the unit and other counters are counts, histogram and summary `_sum`
+// have the unit of the observations, and `_count` and `_bucket` are counts
+func inferUnit(name string) (string, float64, bool) {
+	switch {
+	case strings.HasSuffix(name, "_count"), strings.HasSuffix(name, "_bucket"):
+		return cloudwatch.StandardUnitCount, 1, true
+	case strings.HasSuffix(name, "_total"):
+		if unit, scale, ok := inferBaseUnit(strings.TrimSuffix(name, "_total")); ok {
+			return unit, scale, true
+		}
+		return cloudwatch.StandardUnitCount, 1, true
+	case strings.HasSuffix(name, "_sum"):
+		return inferBaseUnit(strings.TrimSuffix(name, "_sum"))
+	}
+	return inferBaseUnit(name)
+}
+
+func inferBaseUnit(name string) (string, float64, bool) {
+	for _, s := range unitSuffixes {
+		if strings.HasSuffix(name, s.suffix) {
+			return s.unit, s.scale, true
+		}
+	}
+	return "", 1, false
+}
+
+// getUnit returns the unit of the metric and the factor converting its values to that unit: the unit and factor of
+// the first matching conversion, the unit of the first matching override, the __cw_unit label, or with unit inference
+// the unit implied by the name. Defaults to None.
+// Units not accepted by CloudWatch are ignored, as they would make the whole request fail
+func (b *Bridge) getUnit(m model.Metric, name string) (string, float64) {
+	for _, c := range b.unitConversions {
+		if c.Matcher.Match(name) {
+			return c.Unit, c.Factor
+		}
+	}
+	for _, o := range b.unitOverrides {
+		if o.Matcher.Match(name) {
+			return o.Unit, 1
+		}
+	}
+	if u, ok := m[cwUnitLabel]; ok && cloudWatchUnits[string(u)] {
+		return string(u), 1
+	}
+	if b.inferUnits {
+		if unit, scale, ok := inferUnit(name); ok {
+			return unit, scale
+		}
+	}
+	return cloudwatch.StandardUnitNone, 1
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestInferUnit(t *testing.T) {
+	tests := []struct {
+		name      string
+		wantUnit  string
+		wantScale float64
+		wantOk    bool
+	}{
+		{"process_cpu_seconds", "Seconds", 1, true},
+		{"request_duration_milliseconds", "Milliseconds", 1, true},
+		{"gc_pause_microseconds", "Microseconds", 1, true},
+		{"node_memory_free_bytes", "Bytes", 1, true},
+		{"link_speed_bits", "Bits", 1, true},
+		{"disk_used_percent", "Percent", 1, true},
+		{"cache_hit_ratio", "Percent", 100, true},
+		{"process_cpu_seconds_total", "Seconds", 1, true},
+		{"node_network_receive_bytes_total", "Bytes", 1, true},
+		{"http_requests_total", "Count", 1, true},
+		{"http_request_duration_seconds_sum", "Seconds", 1, true},
+		{"response_size_bytes_sum", "Bytes", 1, true},
+		{"http_request_duration_seconds_count", "Count", 1, true},
+		{"http_request_duration_seconds_bucket", "Count", 1, true},
+		{"queue_sum", "", 1, false},
+		{"up", "", 1, false},
+		{"seconds_since_boot", "", 1, false},
+	}
+	for _, tt := range tests {
+		unit, scale, ok := inferUnit(tt.name)
+		if unit != tt.wantUnit || scale != tt.wantScale || ok != tt.wantOk {
+			t.Errorf("inferUnit(%q) = %q, %v, %t, want %q, %v, %t", tt.name, unit, scale, ok, tt.wantUnit, tt.wantScale, tt.wantOk)
+		}
+	}
+}
+
+func TestGetUnit(t *testing.T) {
+	conversion, err := NewUnitConversion("*_seconds", "Milliseconds", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	override, err := NewUnitOverride("*_seconds", "Microseconds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labelled := model.Metric{"__name__": "latency_seconds", cwUnitLabel: "Count"}
+	unlabelled := model.Metric{"__name__": "latency_seconds"}
+
+	tests := []struct {
+		name       string
+		bridge     *Bridge
+		metric     model.Metric
+		wantUnit   string
+		wantFactor float64
+	}{
+		{"conversion wins", &Bridge{unitConversions: []UnitConversion{conversion}, unitOverrides: []UnitOverride{override}, inferUnits: true}, labelled, "Milliseconds", 1000},
+		{"override wins over the label", &Bridge{unitOverrides: []UnitOverride{override}, inferUnits: true}, labelled, "Microseconds", 1},
+		{"label wins over inference", &Bridge{inferUnits: true}, labelled, "Count", 1},
+		{"invalid label is ignored", &Bridge{inferUnits: true}, model.Metric{"__name__": "latency_seconds", cwUnitLabel: "Minutes"}, "Seconds", 1},
+		{"inference", &Bridge{inferUnits: true}, unlabelled, "Seconds", 1},
+		{"inferred scale", &Bridge{inferUnits: true}, model.Metric{"__name__": "hit_ratio"}, "Percent", 100},
+		{"no inference", &Bridge{}, unlabelled, "None", 1},
+		{"nothing to infer", &Bridge{inferUnits: true}, model.Metric{"__name__": "up"}, "None", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unit, factor := tt.bridge.getUnit(tt.metric, string(tt.metric[model.MetricNameLabel]))
+			if unit != tt.wantUnit || factor != tt.wantFactor {
+				t.Errorf("getUnit() = %q, %v, want %q, %v", unit, factor, tt.wantUnit, tt.wantFactor)
+			}
+		})
+	}
+}
+
+func TestNewUnitOverride(t *testing.T) {
+	if _, err := NewUnitOverride("*_seconds", "Secs"); err == nil {
+		t.Error("NewUnitOverride accepted an invalid unit")
+	}
+	if _, err := NewUnitOverride("[", "Seconds"); err == nil {
+		t.Error("NewUnitOverride accepted an invalid pattern")
+	}
+	o, err := NewUnitOverride("jvm_memory_*", "Bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !o.Matcher.Match("jvm_memory_used") || o.Matcher.Match("jvm_threads") {
+		t.Error("override doesn't match its pattern")
+	}
+}
+
+func TestParseUnitConversion(t *testing.T) {
+	tests := []struct {
+		spec       string
+		wantUnit   string
+		wantFactor float64
+		wantErr    bool
+	}{
+		{spec: "Milliseconds*1000", wantUnit: "Milliseconds", wantFactor: 1000},
+		{spec: "Percent*100", wantUnit: "Percent", wantFactor: 100},
+		{spec: "Megabytes/1048576", wantUnit: "Megabytes", wantFactor: 1.0 / 1048576},
+		{spec: "Kilobytes/1e3", wantUnit: "Kilobytes", wantFactor: 0.001},
+		{spec: "Count*-1", wantUnit: "Count", wantFactor: -1},
+		{spec: "Seconds", wantUnit: "Seconds", wantFactor: 1},
+		{spec: "Bytes/Second", wantUnit: "Bytes/Second", wantFactor: 1},
+		{spec: "Bytes/Second*8", wantUnit: "Bytes/Second", wantFactor: 8},
+		{spec: "Kilobits/Second/1000", wantUnit: "Kilobits/Second", wantFactor: 0.001},
+		{spec: "Seconds*0", wantErr: true},
+		{spec: "Seconds/0", wantErr: true},
+		{spec: "Seconds*Inf", wantErr: true},
+		{spec: "Seconds*NaN", wantErr: true},
+		{spec: "Seconds*many", wantErr: true},
+		{spec: "Minutes*60", wantErr: true},
+		{spec: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		c, err := ParseUnitConversion("*_seconds", tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseUnitConversion(%q) = %+v, want an error", tt.spec, c)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseUnitConversion(%q) error = %v", tt.spec, err)
+			continue
+		}
+		if c.Unit != tt.wantUnit || c.Factor != tt.wantFactor {
+			t.Errorf("ParseUnitConversion(%q) = %q, %v, want %q, %v", tt.spec, c.Unit, c.Factor, tt.wantUnit, tt.wantFactor)
+		}
+	}
+}
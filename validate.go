@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// CloudWatch accepts metric names and namespaces of up to 255 characters
+const (
+	cwMaxMetricNameLength = 255
+	cwMaxNamespaceLength  = 255
+)
+
+// cwNamespaceRegex matches the namespaces accepted by CloudWatch. Namespaces starting with AWS/ are reserved
+var cwNamespaceRegex = regexp.MustCompile(`^[0-9A-Za-z.\-_/#: ]+$`)
+
+// validateNamespace checks the namespace against the CloudWatch limits
+func validateNamespace(namespace string) error {
+	if len(namespace) > cwMaxNamespaceLength {
+		return fmt.Errorf("namespace longer than %d characters", cwMaxNamespaceLength)
+	}
+	if !cwNamespaceRegex.MatchString(namespace) {
+		return errors.New("namespace with characters other than alphanumerics, spaces and .-_/#:")
+	}
+	if strings.HasPrefix(namespace, ":") {
+		return errors.New("namespace starting with a colon")
+	}
+	if strings.HasPrefix(namespace, "AWS/") {
+		return errors.New("namespace reserved for AWS services")
+	}
+	return nil
+}
+
+// validateDatum checks the datum against the CloudWatch limits, as a single invalid datum makes CloudWatch reject
+// the whole request
+func validateDatum(datum *cloudwatch.MetricDatum, now time.Time) error {
+	if err := datum.Validate(); err != nil {
+		return err
+	}
+
+	name := aws.StringValue(datum.MetricName)
+	if len(name) > cwMaxMetricNameLength {
+		return fmt.Errorf("metric name longer than %d characters", cwMaxMetricNameLength)
+	}
+	if len(datum.Dimensions) > cwMaxDimensions {
+		return fmt.Errorf("more than %d dimensions", cwMaxDimensions)
+	}
+	if datum.Unit != nil && !cloudWatchUnits[*datum.Unit] {
+		return fmt.Errorf("invalid unit %q", *datum.Unit)
+	}
+	if datum.Timestamp != nil {
+		if datum.Timestamp.Before(now.Add(-cwMaxTimestampAge)) {
+			return errors.New("timestamp older than two weeks")
+		}
+		if datum.Timestamp.After(now.Add(cwMaxTimestampFuture)) {
+			return errors.New("timestamp more than two hours in the future")
+		}
+	}
+
+	if st := datum.StatisticValues; st != nil {
+		if datum.Value != nil {
+			return errors.New("both a value and statistic values")
+		}
+		for _, v := range []*float64{st.Minimum, st.Maximum, st.Sum, st.SampleCount} {
+			if !validValue(aws.Float64Value(v)) {
+				return fmt.Errorf("statistic value %v out of the accepted range", aws.Float64Value(v))
+			}
+		}
+		if *st.SampleCount <= 0 {
+			return errors.New("statistic values with a sample count of 0")
+		}
+		if *st.Minimum > *st.Maximum {
+			return errors.New("statistic values with a minimum above the maximum")
+		}
+	} else if datum.Value == nil || !validValue(*datum.Value) {
+		return errors.New("value missing or out of the accepted range")
+	}
+	return nil
+}
+
+// appendValidDatum appends the datum to the batch, unless it is invalid, in which case it is logged and dropped
+func appendValidDatum(data []*cloudwatch.MetricDatum, datum *cloudwatch.MetricDatum) []*cloudwatch.MetricDatum {
+	if err := validateDatum(datum, time.Now()); err != nil {
+		log.Printf("prometheus-to-cloudwatch: dropping invalid datum %s: %s", describeDatum(datum), err)
+		return data
+	}
+	return append(data, datum)
+}
+
+// isInvalidDatumError reports whether CloudWatch rejected a request because of its content (e.g. InvalidParameterValue)
+func isInvalidDatumError(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusBadRequest && !request.IsErrorThrottle(err)
+	}
+	return false
+}
+
+// flush publishes the datums. When CloudWatch rejects the batch because of an invalid datum, the batch is bisected
+// to publish the valid datums, and the rejected datums are logged
+func (d *destination) flush(ctx context.Context, namespace string, data []*cloudwatch.MetricDatum) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	err := d.put(ctx, namespace, data)
+	if err == nil || !isInvalidDatumError(err) {
+		return err
+	}
+	if len(data) == 1 {
+		log.Printf("prometheus-to-cloudwatch: CloudWatch in %s rejected %s: %s", d.name, describeDatum(data[0]), err)
+		return nil
+	}
+
+	mid := len(data) / 2
+	firstErr := d.flush(ctx, namespace, data[:mid])
+	if err := d.flush(ctx, namespace, data[mid:]); err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// describeDatum formats the name and dimensions of the datum like a Prometheus series
+func describeDatum(datum *cloudwatch.MetricDatum) string {
+	dims := make([]string, 0, len(datum.Dimensions))
+	for _, dim := range datum.Dimensions {
+		dims = append(dims, fmt.Sprintf("%s=%q", aws.StringValue(dim.Name), aws.StringValue(dim.Value)))
+	}
+	return fmt.Sprintf("%s{%s}", aws.StringValue(datum.MetricName), strings.Join(dims, ", "))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/gobwas/glob"
+)
+
+func TestFlushBisectsInvalidDatums(t *testing.T) {
+	cw := newFakeCloudWatch(t)
+	cw.rejected = "invalid"
+
+	b := newTestBridge(t, &Config{PrometheusScrapeUrl: "http://localhost:9100/metrics"}, cw)
+	var data []*cloudwatch.MetricDatum
+	for _, name := range []string{"a", "b", "invalid", "c", "d"} {
+		data = append(data, &cloudwatch.MetricDatum{MetricName: aws.String(name), Value: aws.Float64(1)})
+	}
+
+	if err := b.destinations[0].flush(context.Background(), "test", data); err != nil {
+		t.Fatalf("flush error = %v, want the invalid datum dropped", err)
+	}
+	if got, want := cw.metricNames(), []string{"a", "b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("published %v, want %v", got, want)
+	}
+}
+
+func TestValidateNamespace(t *testing.T) {
+	tests := []struct {
+		namespace string
+		valid     bool
+	}{
+		{"Team/A", true},
+		{"My App: prod #1", true},
+		{"kafka.brokers-1_a", true},
+		{"AWS/EC2", false},
+		{":Team", false},
+		{"Équipe", false},
+		{"team\n", false},
+		{"team*", false},
+		{strings.Repeat("a", 255), true},
+		{strings.Repeat("a", 256), false},
+	}
+	for _, tt := range tests {
+		if err := validateNamespace(tt.namespace); (err == nil) != tt.valid {
+			t.Errorf("validateNamespace(%q) = %v, want valid %t", tt.namespace, err, tt.valid)
+		}
+	}
+}
+
+func TestNewBridgeRejectsInvalidNamespaces(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{"valid", Config{NamespaceRules: []NamespaceRule{{Matcher: glob.MustCompile("kafka_*"), Namespace: "Kafka"}}, Destinations: []Destination{{Region: "eu-west-1", Namespace: "Team/A"}}}, ""},
+		{"default namespace", Config{CloudWatchNamespace: "AWS/EC2"}, "invalid CloudWatchNamespace"},
+		{"namespace rule", Config{NamespaceRules: []NamespaceRule{{Matcher: glob.MustCompile("kafka_*"), Namespace: "Kafka*"}}}, "invalid namespace \"Kafka*\" in NamespaceRules"},
+		{"destination namespace", Config{Destinations: []Destination{{Region: "eu-west-1", Namespace: ":Team"}}}, "invalid namespace \":Team\" of destination eu-west-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config
+			if c.CloudWatchNamespace == "" {
+				c.CloudWatchNamespace = "test"
+			}
+			c.CloudWatchRegion = "us-east-1"
+			c.PrometheusScrapeUrl = "http://localhost:9100/metrics"
+			_, err := NewBridge(&c)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("NewBridge error = %v, want the namespaces accepted", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewBridge error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}